@@ -8,8 +8,10 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
@@ -24,6 +26,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/danmaid/wsconsole/internal/auth"
+	"github.com/danmaid/wsconsole/internal/recording"
 	"github.com/danmaid/wsconsole/internal/ws"
 )
 
@@ -37,6 +41,48 @@ var (
 	certFile         = flag.String("cert", "", "Path to TLS certificate file (auto-generated if empty and TLS enabled)")
 	keyFile          = flag.String("key", "", "Path to TLS key file (auto-generated if empty and TLS enabled)")
 	pathPrefix       = flag.String("path-prefix", "", "Path prefix for reverse proxy setup (e.g., /wsconsole)")
+	sessionGrace     = flag.Duration("session-grace", ws.DefaultSessionGrace, "How long a detached session is kept for reattach (0 disables)")
+	scrollbackSize   = flag.Int("scrollback", ws.DefaultScrollbackSize, "Bytes of recent output replayed when a session is reattached")
+	flowWindow       = flag.Int64("flow-window", ws.DefaultFlowWindow, "Maximum flow control window in bytes a client may negotiate (0 disables flow control)")
+	coalesceDelay    = flag.Duration("coalesce-delay", ws.DefaultCoalesceDelay, "Maximum time a burst of PTY output is held to merge it into fewer frames (0 disables)")
+	coalesceBytes    = flag.Int("coalesce-bytes", ws.DefaultCoalesceBytes, "Send merged PTY output immediately once it reaches this many bytes")
+	compression      = flag.Bool("compression", false, "Accept permessage-deflate compression when offered by the client")
+	compressionLevel = flag.Int("compression-level", ws.DefaultCompressionLevel, "Compression level from 1 (fastest) to 9 (smallest)")
+	compressionMin   = flag.Int("compression-min-size", ws.DefaultCompressionMinSize, "Messages smaller than this many bytes are sent uncompressed")
+	ttydCredential   = flag.String("ttyd-credential", "", "Credential (user:password) ttyd clients must authenticate with (disabled if empty)")
+	idleTimeout      = flag.Duration("idle-timeout", ws.DefaultIdleTimeout, "Close sessions without input or output for this long (0 disables)")
+	idleWarning      = flag.Duration("idle-warning", ws.DefaultIdleWarning, "Warn clients this long before a session is closed for inactivity or age (0 disables)")
+	maxLifetime      = flag.Duration("max-lifetime", 0, "Close sessions this long after they started regardless of activity (0 disables)")
+	allowedOrigins   = flag.String("allowed-origins", "", "Comma-separated origins allowed to connect besides the page's own (e.g. https://app.example.com,https://*.example.com)")
+	csrfEnabled      = flag.Bool("csrf", false, "Require the CSRF token issued with the terminal page on browser WebSocket requests")
+	authHtpasswd     = flag.String("auth-htpasswd", "", "Require HTTP Basic authentication against this htpasswd file (bcrypt entries)")
+	authTokens       = flag.String("auth-tokens", "", "Accept bearer tokens listed in this file, one name:token per line")
+	authLoginForm    = flag.Bool("auth-login-form", false, "Offer a login form backed by -auth-htpasswd that issues a session cookie")
+	authCookieTTL    = flag.Duration("auth-cookie-ttl", auth.DefaultCookieTTL, "How long a login form session lasts")
+	jwtSecretFile    = flag.String("jwt-secret-file", "", "Accept HS256 JSON Web Tokens on /ws signed with the secret in this file (on its own, requires -static \"\")")
+	jwtJWKS          = flag.String("jwt-jwks", "", "Accept RS256/ES256 JSON Web Tokens on /ws signed with keys from this JWKS file (on its own, requires -static \"\")")
+	jwtIssuer        = flag.String("jwt-issuer", "", "Required iss claim of JSON Web Tokens (not checked if empty)")
+	jwtAudience      = flag.String("jwt-audience", "", "Required aud claim of JSON Web Tokens (not checked if empty)")
+	clientCA         = flag.String("client-ca", "", "Require TLS client certificates signed by a CA in this PEM bundle")
+	clientIdentity   = flag.String("client-cert-identity", "cn", "Client certificate attribute used as the identity: cn, email, dns or uri")
+	launcherPolicy   = flag.String("launcher-policy", "", "Restrict launchers to identities, e.g. direct=alice,bob;systemd-run=* (unrestricted if empty)")
+	signals          = flag.String("signals", ws.DefaultSignals, "Comma-separated signals clients may send to the session (none if empty)")
+	clipboard        = flag.String("clipboard", string(ws.ClipboardConfirm), "OSC 52 clipboard access from the terminal: allow, strip or confirm")
+	terminalQueries  = flag.String("terminal-queries", string(ws.QueriesStrip), "Title report and DECRQSS queries in the output: allow or strip")
+	maxTransferSize  = flag.Int64("max-transfer-size", ws.DefaultMaxTransferSize, "Maximum size in bytes of a file uploaded or downloaded over the JSON protocol (0 disables file transfer)")
+	oidcIssuer       = flag.String("oidc-issuer", "", "Log users in with this OpenID Connect provider (disabled if empty)")
+	oidcClientID     = flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcSecretFile   = flag.String("oidc-client-secret-file", "", "File containing the OpenID Connect client secret (public client with PKCE only if empty)")
+	oidcRedirectURL  = flag.String("oidc-redirect-url", "", "External URL of the OpenID Connect callback, e.g. https://console.example.com/oidc/callback")
+	oidcScopes       = flag.String("oidc-scopes", "profile email", "Space-separated scopes requested in addition to openid")
+	oidcUserClaim    = flag.String("oidc-username-claim", "preferred_username", "ID token claim used as the user name (sub if missing)")
+	oidcGroupsClaim  = flag.String("oidc-groups-claim", "groups", "ID token claim listing the user's groups")
+	rateLimit        = flag.Float64("rate-limit", ws.DefaultRateLimit, "Requests allowed per second per remote IP, checked before authentication (0 disables; set 0 behind a reverse proxy, where all clients share its IP, and limit there)")
+	rateBurst        = flag.Int("rate-burst", ws.DefaultRateBurst, "Requests a remote IP may make in a burst")
+	maxSessions      = flag.Int("max-sessions", ws.DefaultMaxSessions, "Maximum number of concurrent sessions (0 means no limit)")
+	maxUserSessions  = flag.Int("max-sessions-per-user", ws.DefaultMaxSessionsPerUser, "Maximum number of concurrent sessions per authenticated identity (0 means no limit)")
+	recordDir        = flag.String("record-dir", "", "Record every session as an asciicast v2 file in this directory (disabled if empty)")
+	recordingAdmins  = flag.String("recording-admins", "", "Comma-separated identities (realm:name) that may list and play every recording; others only see their own")
 )
 
 // Version is set during build with -ldflags
@@ -128,6 +174,149 @@ func generateSelfSignedCert() (string, string, error) {
 	return certPath, keyPath, nil
 }
 
+// clientCertTLSConfig returns a TLS configuration that rejects clients
+// without a certificate signed by a CA in the PEM bundle at path.
+func clientCertTLSConfig(path string) (*tls.Config, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// setupAuth builds the authentication gate from the -auth-* flags and
+// registers the login form routes on mux. It returns nil if no
+// authentication is configured.
+func setupAuth(mux *http.ServeMux, prefix string) (*auth.Gate, error) {
+	var authenticators []auth.Authenticator
+	if *clientCA != "" {
+		certs, err := auth.NewClientCert(*clientIdentity)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, certs)
+	}
+	if *jwtSecretFile != "" || *jwtJWKS != "" {
+		keys := &auth.KeySet{}
+		if *jwtJWKS != "" {
+			var err error
+			if keys, err = auth.LoadJWKS(*jwtJWKS); err != nil {
+				return nil, err
+			}
+		}
+		if *jwtSecretFile != "" {
+			secret, err := os.ReadFile(*jwtSecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read JWT secret: %w", err)
+			}
+			secret = []byte(strings.TrimSpace(string(secret)))
+			if len(secret) < 32 {
+				return nil, fmt.Errorf("JWT secret must be at least 32 bytes")
+			}
+			keys.AddSecret(secret)
+		}
+		// Tokens are single-use, so they are only accepted where a session is opened
+		jwt := auth.NewJWT(keys, *jwtIssuer, *jwtAudience)
+		authenticators = append(authenticators, auth.OnlyPaths(jwt, prefix+"/ws"))
+	}
+	var passwords *auth.Htpasswd
+	var cookies *auth.Cookies
+	if *authHtpasswd != "" {
+		var err error
+		if passwords, err = auth.LoadHtpasswd(*authHtpasswd); err != nil {
+			return nil, err
+		}
+	}
+	if *authLoginForm && passwords == nil {
+		return nil, fmt.Errorf("-auth-login-form requires -auth-htpasswd")
+	}
+	if *authLoginForm || *oidcIssuer != "" {
+		var err error
+		if cookies, err = auth.NewCookies(*authCookieTTL); err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, cookies)
+	}
+	var oidc *auth.OIDC
+	if *oidcIssuer != "" {
+		cfg := auth.OIDCConfig{
+			Issuer:        *oidcIssuer,
+			ClientID:      *oidcClientID,
+			RedirectURL:   *oidcRedirectURL,
+			Scopes:        strings.Fields(*oidcScopes),
+			UsernameClaim: *oidcUserClaim,
+			GroupsClaim:   *oidcGroupsClaim,
+		}
+		if *oidcSecretFile != "" {
+			secret, err := os.ReadFile(*oidcSecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read OpenID Connect client secret: %w", err)
+			}
+			cfg.ClientSecret = strings.TrimSpace(string(secret))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		var err error
+		if oidc, err = auth.NewOIDC(ctx, cfg, cookies); err != nil {
+			return nil, err
+		}
+	}
+	if passwords != nil {
+		authenticators = append(authenticators, passwords)
+	}
+	if *authTokens != "" {
+		tokens, err := auth.LoadTokens(*authTokens)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if len(authenticators) == 0 {
+		return nil, nil
+	}
+	if len(authenticators) == 1 && (*jwtSecretFile != "" || *jwtJWKS != "") {
+		// Nothing else could authenticate the request for the UI page
+		if info, err := os.Stat(*staticDir); err == nil && info.IsDir() {
+			return nil, fmt.Errorf("JSON Web Tokens are only accepted on %s/ws, so the UI in %s cannot be loaded: add another authentication method, or set -static \"\" and serve the UI from elsewhere", prefix, *staticDir)
+		}
+	}
+
+	gate := auth.NewGate(authenticators...)
+	gate.Allow(prefix + "/healthz")
+	if *authLoginForm {
+		loginPath := prefix + "/login"
+		mux.Handle(loginPath, auth.LoginHandler(cookies, passwords, prefix+"/"))
+		gate.SetLoginPath(loginPath)
+	}
+	if oidc != nil {
+		// Browsers are sent to the provider rather than the login form
+		loginPath := prefix + "/oidc/login"
+		mux.Handle(loginPath, oidc.LoginHandler(prefix+"/"))
+		mux.Handle(prefix+"/oidc/callback", oidc.CallbackHandler())
+		gate.SetLoginPath(loginPath)
+		gate.Allow(prefix + "/oidc/callback")
+	}
+	if cookies != nil {
+		mux.Handle(prefix+"/logout", auth.LogoutHandler(cookies, prefix+"/"))
+	}
+	slog.Info("authentication enabled",
+		"htpasswd", *authHtpasswd,
+		"tokens", *authTokens,
+		"login_form", *authLoginForm,
+		"client_ca", *clientCA,
+		"oidc_issuer", *oidcIssuer,
+		"jwt", *jwtSecretFile != "" || *jwtJWKS != "")
+	return gate, nil
+}
+
 // loggingMiddleware wraps an HTTP handler with request/response logging
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -200,7 +389,11 @@ func main() {
 		"addr", *addr,
 		"tls_enabled", *tlsEnabled,
 		"path_prefix", *pathPrefix,
-		"launcher_strategy", *launcherStrategy)
+		"launcher_strategy", *launcherStrategy,
+		"session_grace", *sessionGrace,
+		"idle_timeout", *idleTimeout,
+		"max_lifetime", *maxLifetime,
+		"record_dir", *recordDir)
 
 	// Normalize path prefix
 	prefix := strings.TrimSuffix(strings.TrimSpace(*pathPrefix), "/")
@@ -212,16 +405,116 @@ func main() {
 	mux := http.NewServeMux()
 
 	// WebSocket endpoint with launcher strategy parameter
+	wsConfig := ws.DefaultConfig()
+	wsConfig.Version = Version
+	wsConfig.SessionGrace = *sessionGrace
+	wsConfig.ScrollbackSize = *scrollbackSize
+	wsConfig.RecordDir = *recordDir
+	wsConfig.FlowWindow = *flowWindow
+	wsConfig.CoalesceDelay = *coalesceDelay
+	wsConfig.CoalesceBytes = *coalesceBytes
+	wsConfig.Compression = *compression
+	wsConfig.CompressionLevel = *compressionLevel
+	wsConfig.CompressionMinSize = *compressionMin
+	wsConfig.TTYDCredential = *ttydCredential
+	wsConfig.IdleTimeout = *idleTimeout
+	wsConfig.IdleWarning = *idleWarning
+	wsConfig.MaxLifetime = *maxLifetime
+	wsConfig.CSRF = *csrfEnabled
+	wsConfig.RateLimit = *rateLimit
+	wsConfig.RateBurst = *rateBurst
+	wsConfig.MaxSessions = *maxSessions
+	wsConfig.MaxSessionsPerUser = *maxUserSessions
+	wsConfig.MaxTransferSize = *maxTransferSize
+	origins, err := ws.ParseOriginPolicy(*allowedOrigins)
+	if err != nil {
+		slog.Error("invalid -allowed-origins", "error", err)
+		os.Exit(1)
+	}
+	wsConfig.Origins = origins
+	if wsConfig.Launchers, err = ws.ParseLauncherPolicy(*launcherPolicy); err != nil {
+		slog.Error("invalid -launcher-policy", "error", err)
+		os.Exit(1)
+	}
+	if wsConfig.Recordings, err = ws.ParseRecordingPolicy(*recordingAdmins); err != nil {
+		slog.Error("invalid -recording-admins", "error", err)
+		os.Exit(1)
+	}
+	if wsConfig.Signals, err = ws.ParseSignalPolicy(*signals); err != nil {
+		slog.Error("invalid -signals", "error", err)
+		os.Exit(1)
+	}
+	if wsConfig.Clipboard, err = ws.ParseClipboardPolicy(*clipboard); err != nil {
+		slog.Error("invalid -clipboard", "error", err)
+		os.Exit(1)
+	}
+	if wsConfig.TerminalQueries, err = ws.ParseQueryPolicy(*terminalQueries); err != nil {
+		slog.Error("invalid -terminal-queries", "error", err)
+		os.Exit(1)
+	}
+	wsHandler := ws.NewHandler(wsConfig)
+
 	wsPath := prefix + "/ws"
 	mux.HandleFunc(wsPath, func(w http.ResponseWriter, r *http.Request) {
 		// Override strategy from query parameter if provided, otherwise use CLI flag
+		// A launcher required by the client's credentials takes precedence
 		query := r.URL.Query()
-		if query.Get("launcher") == "" && *launcherStrategy != "auto" {
+		ident := auth.FromContext(r.Context())
+		if query.Get("launcher") == "" && *launcherStrategy != "auto" && (ident == nil || ident.Launcher == "") {
 			// Add launcher strategy to query if not already present
 			query.Set("launcher", *launcherStrategy)
 			r.URL.RawQuery = query.Encode()
 		}
-		ws.Handler(w, r)
+		wsHandler.ServeHTTP(w, r)
+	})
+
+	// ttyd clients fetch an auth token before connecting to /ws
+	mux.HandleFunc(prefix+"/token", wsHandler.ServeTTYDToken)
+
+	// Recording list and playback endpoints
+	if *recordDir != "" {
+		recordingsPath := prefix + "/recordings"
+		mux.HandleFunc(recordingsPath, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			infos, err := recording.List(*recordDir)
+			if err != nil {
+				slog.Error("failed to list recordings", "error", err)
+				http.Error(w, "failed to list recordings", http.StatusInternalServerError)
+				return
+			}
+			// Recordings hold what other users typed and saw, so each user
+			// only lists their own unless an administrator. The session may
+			// still be live, so only its owner learns the ID.
+			ident := auth.FromContext(r.Context())
+			permitted := []recording.Info{}
+			for _, info := range infos {
+				if !wsConfig.Recordings.Permits(ident, info.User, info.Realm) {
+					continue
+				}
+				if ident == nil || info.User != ident.Name || info.Realm != ident.Realm() {
+					info.Session = ""
+				}
+				permitted = append(permitted, info)
+			}
+			infos = permitted
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(infos); err != nil {
+				slog.Warn("failed to write recordings response", "error", err)
+			}
+		})
+		mux.Handle(recordingsPath+"/play", ws.NewPlaybackHandler(*recordDir, wsConfig))
+	}
+
+	// Output and per-session compression statistics endpoint
+	statsPath := prefix + "/stats"
+	mux.HandleFunc(statsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(wsHandler.Stats(auth.FromContext(r.Context()))); err != nil {
+			slog.Warn("failed to write stats response", "error", err)
+		}
 	})
 
 	// Health check endpoint
@@ -239,6 +532,9 @@ func main() {
 	if info, err := os.Stat(*staticDir); err == nil && info.IsDir() {
 		slog.Info("serving static files", "dir", *staticDir)
 		fs := http.FileServer(http.Dir(*staticDir))
+		if *csrfEnabled {
+			fs = ws.IssueCSRFToken(fs)
+		}
 		indexPath := prefix + "/"
 		mux.Handle(indexPath, fs)
 	} else {
@@ -269,8 +565,26 @@ func main() {
 		})
 	}
 
+	// Authenticate every request before it reaches a handler, so that
+	// unauthenticated clients never get a login prompt
+	gate, err := setupAuth(mux, prefix)
+	if err != nil {
+		slog.Error("failed to set up authentication", "error", err)
+		os.Exit(1)
+	}
+	var handler http.Handler = mux
+	if gate != nil {
+		handler = gate.Wrap(mux)
+	} else {
+		slog.Warn("authentication disabled, anyone reaching the server gets a login prompt")
+	}
+
+	// Throttle clients before authentication, so that guessing credentials
+	// is as slow as any other request
+	handler = wsHandler.RateLimit(handler)
+
 	// Add HTTP access logging middleware
-	handler := loggingMiddleware(mux)
+	handler = loggingMiddleware(handler)
 
 	// Create HTTP server
 	server := &http.Server{
@@ -280,6 +594,18 @@ func main() {
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	if *clientCA != "" {
+		if !*tlsEnabled {
+			slog.Error("-client-ca requires TLS")
+			os.Exit(1)
+		}
+		tlsConfig, err := clientCertTLSConfig(*clientCA)
+		if err != nil {
+			slog.Error("failed to load client CA bundle", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = tlsConfig
+	}
 
 	// Start server in a goroutine
 	go func() {
@@ -337,5 +663,8 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Hijacked WebSocket connections are not tracked by Shutdown, so end sessions explicitly
+	wsHandler.Close()
+
 	slog.Info("server stopped")
 }
@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/creack/pty v1.1.21
 	github.com/gorilla/websocket v1.5.1
+	golang.org/x/crypto v0.18.0
 	golang.org/x/sys v0.17.0
 )
 
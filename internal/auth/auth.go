@@ -0,0 +1,166 @@
+//go:build linux
+// +build linux
+
+// Package auth authenticates HTTP requests before they reach the terminal,
+// so that unauthenticated clients never get a login prompt to brute force.
+package auth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoCredentials means the request carries no credentials for an
+	// authenticator, so the next one should be tried.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials means the request carries credentials that
+	// were rejected.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is an authenticated user.
+type Identity struct {
+	Name   string
+	Method string   // authenticator that accepted the request, e.g. "basic"
+	Groups []string // group memberships asserted by the identity provider
+
+	// Constraints on the sessions the user opens, set by credentials that
+	// carry them (see JWT). Zero values leave the server defaults.
+	Launcher    string        // required launcher strategy
+	LoginUser   string        // user login prompts the password of
+	MaxLifetime time.Duration // shortens the server's session lifetime limit
+	IdleTimeout time.Duration // shortens the server's idle timeout
+}
+
+// Realm returns the namespace id's name belongs to, e.g. "htpasswd" or
+// "jwt". Equal names in different realms are different users: a JWT
+// subject "alice" is not the htpasswd user alice. The login form and HTTP
+// Basic authentication check the same htpasswd file and share its realm.
+func (id *Identity) Realm() string {
+	switch id.Method {
+	case "basic", "form":
+		return "htpasswd"
+	}
+	return id.Method
+}
+
+// Key identifies the user across realms as "realm:name".
+func (id *Identity) Key() string {
+	return id.Realm() + ":" + id.Name
+}
+
+// Authenticator checks the credentials carried by a request.
+type Authenticator interface {
+	// Authenticate returns the identity behind r, ErrNoCredentials when r
+	// carries no credentials of this kind, or another error when they are
+	// invalid.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Challenger is implemented by authenticators that advertise themselves in
+// the WWW-Authenticate header of 401 responses.
+type Challenger interface {
+	Challenge() string
+}
+
+type contextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity stored by Gate, or nil.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// Gate requires requests to authenticate with one of its authenticators
+// before passing them on. Failures get 401 Unauthorized; browsers asking
+// for a page are redirected to the login form instead when there is one.
+type Gate struct {
+	authenticators []Authenticator
+	loginPath      string
+	public         map[string]bool
+}
+
+// NewGate returns a gate trying the authenticators in order.
+func NewGate(authenticators ...Authenticator) *Gate {
+	return &Gate{authenticators: authenticators, public: make(map[string]bool)}
+}
+
+// SetLoginPath redirects unauthenticated page requests to path, which is
+// reachable without authentication.
+func (g *Gate) SetLoginPath(path string) {
+	g.loginPath = path
+	g.public[path] = true
+}
+
+// Allow makes path reachable without authentication (e.g. health checks).
+func (g *Gate) Allow(path string) {
+	g.public[path] = true
+}
+
+// Authenticate returns the identity of the first authenticator accepting r.
+// Invalid credentials are rejected even if a later authenticator would
+// accept the request, so a wrong password cannot fall through.
+func (g *Gate) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range g.authenticators {
+		id, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// Wrap protects next.
+func (g *Gate) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g.public[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, err := g.Authenticate(r)
+		if err != nil {
+			g.reject(w, r, err)
+			return
+		}
+		slog.Debug("request authenticated", "user", id.Name, "method", id.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+	})
+}
+
+func (g *Gate) reject(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrNoCredentials) && g.loginPath != "" && wantsPage(r) {
+		http.Redirect(w, r, g.loginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	if !errors.Is(err, ErrNoCredentials) {
+		slog.Info("authentication failed", "remote", r.RemoteAddr, "path", r.URL.Path, "error", err)
+	}
+	seen := make(map[string]bool)
+	for _, a := range g.authenticators {
+		if c, ok := a.(Challenger); ok && c.Challenge() != "" && !seen[c.Challenge()] {
+			seen[c.Challenge()] = true
+			w.Header().Add("WWW-Authenticate", c.Challenge())
+		}
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// wantsPage reports whether r is a browser navigation rather than an API
+// or WebSocket request.
+func wantsPage(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(r.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// BearerToken returns the token from an "Authorization: Bearer" header, or
+// from the access_token query parameter since browsers cannot set headers
+// on WebSocket requests.
+func BearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// Tokens accepts static bearer tokens read from a file with one
+// "name:token" entry per line; the name identifies the client in logs.
+type Tokens struct {
+	tokens map[[sha256.Size]byte]string // token digest -> name
+}
+
+// LoadTokens reads a tokens file.
+func LoadTokens(path string) (*Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tokens file: %w", err)
+	}
+	defer f.Close()
+
+	t := &Tokens{tokens: make(map[[sha256.Size]byte]string)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, token, ok := strings.Cut(text, ":")
+		if !ok || name == "" || len(token) < 16 {
+			return nil, fmt.Errorf("invalid token entry on line %d: want name:token with at least 16 characters", line)
+		}
+		t.tokens[sha256.Sum256([]byte(token))] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+	return t, nil
+}
+
+// Authenticate implements Authenticator. Tokens are compared by digest so
+// the lookup does not leak how much of a guessed token matched.
+func (t *Tokens) Authenticate(r *http.Request) (*Identity, error) {
+	token := BearerToken(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	digest := sha256.Sum256([]byte(token))
+	for known, name := range t.tokens {
+		if subtle.ConstantTimeCompare(known[:], digest[:]) == 1 {
+			return &Identity{Name: name, Method: "token"}, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// Challenge implements Challenger.
+func (t *Tokens) Challenge() string {
+	return `Bearer realm="wsconsole"`
+}
@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// ClientCert identifies users by the TLS client certificate they presented.
+// The certificate chain is verified by the TLS server against the
+// configured CA bundle; this only maps the certificate to a name.
+type ClientCert struct {
+	field string
+}
+
+// NewClientCert returns a client certificate authenticator naming users by
+// field: "cn" for the subject common name, or "email", "dns" or "uri" for
+// the first subject alternative name of that type.
+func NewClientCert(field string) (*ClientCert, error) {
+	switch field {
+	case "cn", "email", "dns", "uri":
+		return &ClientCert{field: field}, nil
+	}
+	return nil, fmt.Errorf("unknown client certificate identity field %q: want cn, email, dns or uri", field)
+}
+
+// Authenticate implements Authenticator.
+func (c *ClientCert) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrNoCredentials
+	}
+	if len(r.TLS.VerifiedChains) == 0 {
+		return nil, fmt.Errorf("%w: client certificate not verified", ErrInvalidCredentials)
+	}
+	cert := r.TLS.PeerCertificates[0]
+	name := c.name(cert)
+	if name == "" {
+		return nil, fmt.Errorf("%w: client certificate %q has no %s", ErrInvalidCredentials, cert.Subject, c.field)
+	}
+	return &Identity{Name: name, Method: "cert"}, nil
+}
+
+func (c *ClientCert) name(cert *x509.Certificate) string {
+	switch c.field {
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
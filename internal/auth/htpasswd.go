@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users, so that response times
+// do not reveal which user names exist.
+var dummyHash = []byte("$2y$10$2b2cU8CPhOTaGrs1HRQuAueS7JTT5ZHsHSzYiFPm1leZck7Mc8T4W")
+
+// Htpasswd checks user names and passwords against an Apache htpasswd
+// file. Only bcrypt ($2y$, created by htpasswd -B) entries are supported;
+// other hash types are rejected when the file is loaded.
+type Htpasswd struct {
+	users map[string][]byte
+}
+
+// LoadHtpasswd reads an htpasswd file.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open htpasswd file: %w", err)
+	}
+	defer f.Close()
+
+	h := &Htpasswd{users: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid htpasswd entry on line %d", line)
+		}
+		if !strings.HasPrefix(hash, "$2") {
+			return nil, fmt.Errorf("unsupported hash for user %q on line %d: use bcrypt (htpasswd -B)", user, line)
+		}
+		h.users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+	return h, nil
+}
+
+// CheckPassword reports whether password is correct for user.
+func (h *Htpasswd) CheckPassword(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password)) //nolint:errcheck // timing only
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// Authenticate implements Authenticator with HTTP Basic authentication.
+func (h *Htpasswd) Authenticate(r *http.Request) (*Identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	if !h.CheckPassword(user, password) {
+		return nil, fmt.Errorf("%w for user %q", ErrInvalidCredentials, user)
+	}
+	return &Identity{Name: user, Method: "basic"}, nil
+}
+
+// Challenge implements Challenger.
+func (h *Htpasswd) Challenge() string {
+	return `Basic realm="wsconsole", charset="UTF-8"`
+}
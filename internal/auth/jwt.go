@@ -0,0 +1,384 @@
+//go:build linux
+// +build linux
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockSkew is the tolerance applied to exp and nbf.
+const clockSkew = 30 * time.Second
+
+var (
+	errTokenExpired  = errors.New("token expired")
+	errTokenReplayed = errors.New("token already used")
+)
+
+// KeySet holds the keys JWT signatures are verified with: HMAC secrets for
+// HS256, and RSA and P-256 public keys for RS256 and ES256. A token is only
+// checked against keys of the type its algorithm requires, so a public key
+// can never be used as an HMAC secret.
+type KeySet struct {
+	keys []verificationKey
+}
+
+type verificationKey struct {
+	id  string
+	key any // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// jsonWebKey is the subset of RFC 7517 fields used for verification.
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// AddSecret adds an HS256 secret.
+func (ks *KeySet) AddSecret(secret []byte) {
+	ks.keys = append(ks.keys, verificationKey{key: secret})
+}
+
+// AddJWKS adds the signing keys of a JSON Web Key Set document.
+func (ks *KeySet) AddJWKS(data []byte) error {
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		ks.keys = append(ks.keys, verificationKey{id: k.Kid, key: key})
+	}
+	return nil
+}
+
+// LoadJWKS reads a JSON Web Key Set file into a new key set.
+func LoadJWKS(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	ks := &KeySet{}
+	if err := ks.AddJWKS(data); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "oct":
+		return decodeSegment(k.K)
+	case "RSA":
+		n, err := decodeSegment(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeSegment(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeSegment(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point not on curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verify checks sig over signed with the keys matching alg and kid.
+func (ks *KeySet) verify(alg, kid string, signed, sig []byte) error {
+	digest := sha256.Sum256(signed)
+	for _, k := range ks.keys {
+		if kid != "" && k.id != "" && k.id != kid {
+			continue
+		}
+		switch key := k.key.(type) {
+		case []byte:
+			if alg != "HS256" {
+				continue
+			}
+			mac := hmac.New(sha256.New, key)
+			mac.Write(signed)
+			if hmac.Equal(sig, mac.Sum(nil)) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if alg == "ES256" && len(sig) == 64 &&
+				ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: bad %s signature", ErrInvalidCredentials, alg)
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64url: %w", err)
+	}
+	return b, nil
+}
+
+// looksLikeJWT reports whether token has the three dot-separated parts of
+// a compact JWS, so that other bearer tokens are left to other authenticators.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// decodeJWT verifies the signature of a compact JWS with keys and decodes
+// its payload into claims. Times are checked by the caller.
+func decodeJWT(token string, keys *KeySet, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed token", ErrInvalidCredentials)
+	}
+	rawHeader, err := decodeSegment(parts[0])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return fmt.Errorf("%w: malformed header", ErrInvalidCredentials)
+	}
+	switch header.Alg {
+	case "HS256", "RS256", "ES256":
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidCredentials, header.Alg)
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	if err := keys.verify(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return err
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return fmt.Errorf("%w: malformed claims", ErrInvalidCredentials)
+	}
+	return nil
+}
+
+// audience is the aud claim, which may be a string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// registeredClaims are the RFC 7519 claims checked for every token.
+type registeredClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expiry    int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	ID        string   `json:"jti"`
+}
+
+// validate checks the issuer, audience and validity period.
+func (c registeredClaims) validate(issuer, aud string, now time.Time) error {
+	if issuer != "" && c.Issuer != issuer {
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidCredentials, c.Issuer)
+	}
+	if aud != "" && !c.Audience.contains(aud) {
+		return fmt.Errorf("%w: token not issued for audience %q", ErrInvalidCredentials, aud)
+	}
+	if c.Expiry == 0 {
+		return fmt.Errorf("%w: token has no expiry", ErrInvalidCredentials)
+	}
+	if now.Add(-clockSkew).Unix() >= c.Expiry {
+		return fmt.Errorf("%w: %w", ErrInvalidCredentials, errTokenExpired)
+	}
+	if c.NotBefore != 0 && now.Add(clockSkew).Unix() < c.NotBefore {
+		return fmt.Errorf("%w: token not valid yet", ErrInvalidCredentials)
+	}
+	return nil
+}
+
+// sessionClaims are the wsconsole claims constraining the session a token
+// opens.
+type sessionClaims struct {
+	registeredClaims
+	Launcher    string `json:"launcher"`     // launcher strategy to use
+	LoginUser   string `json:"login_user"`   // user login prompts the password of
+	MaxLifetime int64  `json:"max_lifetime"` // seconds
+	IdleTimeout int64  `json:"idle_timeout"` // seconds
+}
+
+// JWT accepts short-lived signed tokens handed out by another application,
+// typically a portal embedding the terminal. Tokens must carry exp and jti
+// and can be used once: the jti is remembered until the token expires.
+type JWT struct {
+	keys     *KeySet
+	issuer   string
+	audience string
+
+	mu   sync.Mutex
+	used map[string]time.Time // jti -> expiry
+}
+
+// NewJWT returns a JWT authenticator verifying tokens with keys. Non-empty
+// issuer and audience must match the iss and aud claims.
+func NewJWT(keys *KeySet, issuer, audience string) *JWT {
+	return &JWT{keys: keys, issuer: issuer, audience: audience, used: make(map[string]time.Time)}
+}
+
+// Authenticate implements Authenticator. Bearer tokens that are not JWTs
+// are left to other authenticators.
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	token := BearerToken(r)
+	if !looksLikeJWT(token) {
+		return nil, ErrNoCredentials
+	}
+	var claims sessionClaims
+	if err := decodeJWT(token, j.keys, &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := claims.validate(j.issuer, j.audience, now); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" || claims.ID == "" {
+		return nil, fmt.Errorf("%w: token needs sub and jti claims", ErrInvalidCredentials)
+	}
+	if claims.MaxLifetime < 0 || claims.IdleTimeout < 0 {
+		return nil, fmt.Errorf("%w: negative session limit", ErrInvalidCredentials)
+	}
+	if err := j.use(claims.ID, time.Unix(claims.Expiry, 0).Add(clockSkew), now); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCredentials, err)
+	}
+	return &Identity{
+		Name:        claims.Subject,
+		Method:      "jwt",
+		Launcher:    claims.Launcher,
+		LoginUser:   claims.LoginUser,
+		MaxLifetime: time.Duration(claims.MaxLifetime) * time.Second,
+		IdleTimeout: time.Duration(claims.IdleTimeout) * time.Second,
+	}, nil
+}
+
+// use records jti as used, failing if it already was.
+func (j *JWT) use(jti string, expiry, now time.Time) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for id, exp := range j.used {
+		if now.After(exp) {
+			delete(j.used, id)
+		}
+	}
+	if _, ok := j.used[jti]; ok {
+		return errTokenReplayed
+	}
+	j.used[jti] = expiry
+	return nil
+}
+
+// Challenge implements Challenger.
+func (j *JWT) Challenge() string {
+	return `Bearer realm="wsconsole"`
+}
+
+// OnlyPaths restricts a to requests for the given paths; elsewhere it
+// reports no credentials.
+func OnlyPaths(a Authenticator, paths ...string) Authenticator {
+	allowed := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		allowed[p] = true
+	}
+	return pathAuthenticator{a, allowed}
+}
+
+type pathAuthenticator struct {
+	Authenticator
+	paths map[string]bool
+}
+
+func (p pathAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if !p.paths[r.URL.Path] {
+		return nil, ErrNoCredentials
+	}
+	return p.Authenticator.Authenticate(r)
+}
+
+// Challenge implements Challenger if the wrapped authenticator does.
+func (p pathAuthenticator) Challenge() string {
+	if c, ok := p.Authenticator.(Challenger); ok {
+		return c.Challenge()
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+//go:build linux
+// +build linux
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signJWT builds a compact JWS over claims with key, which is a secret,
+// an *rsa.PrivateKey or an *ecdsa.PrivateKey.
+func signJWT(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func testJWKS(t *testing.T) (*KeySet, *rsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kid": "rsa", "kty": "RSA", "use": "sig",
+			"n": b64.EncodeToString(rsaKey.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kid": "ec", "kty": "EC", "crv": "P-256",
+			"x": b64.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			"y": b64.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}})
+	keys, err := LoadJWKS(writeFile(t, string(jwks)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys, rsaKey, ecKey
+}
+
+func TestJWT(t *testing.T) {
+	keys, rsaKey, ecKey := testJWKS(t)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	keys.AddSecret(secret)
+	j := NewJWT(keys, "portal", "wsconsole")
+
+	now := time.Now()
+	claims := func(jti string, extra map[string]any) map[string]any {
+		c := map[string]any{"iss": "portal", "aud": "wsconsole", "sub": "alice", "jti": jti, "exp": now.Add(time.Minute).Unix()}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	authenticate := func(token string) (*Identity, error) {
+		return j.Authenticate(httptest.NewRequest("GET", "/ws?access_token="+token, nil))
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"HS256", signJWT(t, "HS256", "", secret, claims("1", nil)), true},
+		{"RS256", signJWT(t, "RS256", "rsa", rsaKey, claims("2", nil)), true},
+		{"ES256", signJWT(t, "ES256", "ec", ecKey, claims("3", nil)), true},
+		{"replayed", signJWT(t, "HS256", "", secret, claims("1", nil)), false},
+		{"expired", signJWT(t, "HS256", "", secret, claims("4", map[string]any{"exp": now.Add(-time.Minute).Unix()})), false},
+		{"no expiry", signJWT(t, "HS256", "", secret, claims("5", map[string]any{"exp": nil})), false},
+		{"wrong issuer", signJWT(t, "HS256", "", secret, claims("6", map[string]any{"iss": "other"})), false},
+		{"wrong audience", signJWT(t, "HS256", "", secret, claims("7", map[string]any{"aud": []string{"other"}})), false},
+		{"no jti", signJWT(t, "HS256", "", secret, claims("", nil)), false},
+		{"wrong key", signJWT(t, "HS256", "", []byte("another secret of at least 32 bytes"), claims("8", nil)), false},
+		{"wrong kid", signJWT(t, "RS256", "ec", rsaKey, claims("9", nil)), false},
+		{"none", signJWT(t, "none", "", []byte{}, claims("10", nil)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := authenticate(tt.token)
+			if tt.ok {
+				if err != nil || id.Name != "alice" || id.Method != "jwt" {
+					t.Fatalf("got %+v, %v", id, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("err = %v, want invalid credentials", err)
+			}
+		})
+	}
+
+	// Session constraints come from the claims
+	id, err := authenticate(signJWT(t, "HS256", "", secret, claims("11", map[string]any{
+		"launcher": "systemd-run", "login_user": "bob", "max_lifetime": 600, "idle_timeout": 60,
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Launcher != "systemd-run" || id.LoginUser != "bob" || id.MaxLifetime != 10*time.Minute || id.IdleTimeout != time.Minute {
+		t.Errorf("identity = %+v", id)
+	}
+
+	// Other bearer tokens are left to other authenticators
+	if _, err := authenticate("0123456789abcdef0123"); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("static token: err = %v, want no credentials", err)
+	}
+}
+
+func TestOnlyPaths(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	keys := &KeySet{}
+	keys.AddSecret(secret)
+	a := OnlyPaths(NewJWT(keys, "", ""), "/ws")
+	token := signJWT(t, "HS256", "", secret, map[string]any{"sub": "alice", "jti": "1", "exp": time.Now().Add(time.Minute).Unix()})
+
+	if _, err := a.Authenticate(httptest.NewRequest("GET", "/stats?access_token="+token, nil)); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("other path: err = %v, want no credentials", err)
+	}
+	if _, err := a.Authenticate(httptest.NewRequest("GET", "/ws?access_token="+token, nil)); err != nil {
+		t.Errorf("/ws: %v", err)
+	}
+}
@@ -0,0 +1,347 @@
+//go:build linux
+// +build linux
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionCookie holds the signed identity issued by the login form or the
+// OpenID Connect login.
+const SessionCookie = "wsconsole_auth"
+
+// DefaultCookieTTL is how long a login session lasts.
+const DefaultCookieTTL = 12 * time.Hour
+
+// PasswordChecker verifies user names and passwords, e.g. *Htpasswd.
+type PasswordChecker interface {
+	CheckPassword(user, password string) bool
+}
+
+// Cookies issues and verifies HMAC-signed session cookies. The signing key
+// is generated at startup, so restarting the server logs everybody out.
+type Cookies struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewCookies returns a cookie authenticator whose sessions last ttl.
+func NewCookies(ttl time.Duration) (*Cookies, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate cookie key: %w", err)
+	}
+	return &Cookies{key: key, ttl: ttl}, nil
+}
+
+// cookieIdentity is the part of an Identity kept in the session cookie.
+type cookieIdentity struct {
+	Name   string   `json:"n"`
+	Method string   `json:"m"` // how the user logged in, e.g. "form"
+	Groups []string `json:"g,omitempty"`
+}
+
+// maxCookieSize keeps session cookies within what browsers store.
+const maxCookieSize = 4000
+
+// Purposes of sealed cookie values. The purpose is part of the signature,
+// so a value issued for one cookie is rejected as any other.
+const (
+	purposeSession   = "session"
+	purposeOIDCState = "oidc-state"
+)
+
+// Issue sets a session cookie for id on w.
+func (c *Cookies) Issue(w http.ResponseWriter, r *http.Request, id *Identity) error {
+	expires := time.Now().Add(c.ttl)
+	value, err := c.seal(purposeSession, cookieIdentity{Name: id.Name, Method: id.Method, Groups: id.Groups}, expires)
+	if err != nil {
+		return err
+	}
+	if len(value) > maxCookieSize {
+		return fmt.Errorf("session cookie for %q too large (%d bytes)", id.Name, len(value))
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Clear removes the session cookie.
+func (c *Cookies) Clear(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (c *Cookies) sign(purpose, payload string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// seal encodes v as a cookie value for purpose, signed and valid until
+// expires.
+func (c *Cookies) seal(purpose string, v any, expires time.Time) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cookie: %w", err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + c.sign(purpose, payload), nil
+}
+
+// open verifies a value made by seal for purpose and decodes it into v.
+// Expired values are reported as ErrNoCredentials, so browsers are asked to
+// log in again.
+func (c *Cookies) open(purpose, value string, v any) error {
+	payload, sig, ok := cutLast(value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(c.sign(purpose, payload))) {
+		return fmt.Errorf("%w: bad cookie signature", ErrInvalidCredentials)
+	}
+	encoded, expiry, _ := cutLast(payload, ".")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() >= unix {
+		return ErrNoCredentials
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(data, v) != nil {
+		return fmt.Errorf("%w: malformed cookie", ErrInvalidCredentials)
+	}
+	return nil
+}
+
+// Authenticate implements Authenticator.
+func (c *Cookies) Authenticate(r *http.Request) (*Identity, error) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrNoCredentials
+	}
+	var id cookieIdentity
+	if err := c.open(purposeSession, cookie.Value, &id); err != nil {
+		return nil, err
+	}
+	return &Identity{Name: id.Name, Method: id.Method, Groups: id.Groups}, nil
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>wsconsole login</title></head>
+<body>
+<h1>wsconsole</h1>
+{{if .Throttled}}<p>Too many failed logins. Try again later.</p>{{else if .Failed}}<p>Invalid user name or password.</p>{{end}}
+<form method="post">
+<input type="hidden" name="next" value="{{.Next}}">
+<p><label>User <input name="user" autocomplete="username" autofocus></label></p>
+<p><label>Password <input name="password" type="password" autocomplete="current-password"></label></p>
+<p><button type="submit">Log in</button></p>
+</form>
+</body>
+</html>
+`))
+
+// LoginHandler serves the login form. A successful POST sets the session
+// cookie and redirects to the next parameter (a local path) or home; a
+// failed one shows the form again with 401 Unauthorized. After repeated
+// failures from the same remote IP or for the same user name, further
+// attempts are refused with 429 Too Many Requests until a backoff delay
+// has passed, without checking the password.
+func LoginHandler(cookies *Cookies, passwords PasswordChecker, home string) http.Handler {
+	backoff := newLoginBackoff()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next := localPath(r.FormValue("next"), home)
+		switch r.Method {
+		case http.MethodGet:
+			renderLogin(w, http.StatusOK, next, false)
+		case http.MethodPost:
+			user := r.PostFormValue("user")
+			keys := loginKeys(r, user)
+			if wait := backoff.wait(keys, time.Now()); wait > 0 {
+				slog.Info("login throttled", "user", user, "remote", r.RemoteAddr, "retry_after", wait)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				renderLogin(w, http.StatusTooManyRequests, next, true)
+				return
+			}
+			if !passwords.CheckPassword(user, r.PostFormValue("password")) {
+				slog.Info("login failed", "user", user, "remote", r.RemoteAddr)
+				backoff.fail(keys, time.Now())
+				renderLogin(w, http.StatusUnauthorized, next, true)
+				return
+			}
+			backoff.succeed(keys)
+			slog.Info("login succeeded", "user", user, "remote", r.RemoteAddr)
+			if err := cookies.Issue(w, r, &Identity{Name: user, Method: "form"}); err != nil {
+				slog.Error("failed to issue session cookie", "error", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, next, http.StatusSeeOther)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// Failed logins are delayed once a remote IP or user name has had
+// loginFreeFailures of them: the wait before the next attempt starts at
+// loginBackoffBase and doubles with each further failure, up to
+// loginBackoffMax. The cap also bounds how long somebody guessing a
+// user's password locks that user out. Failures are forgotten after
+// loginForget without any.
+const (
+	loginFreeFailures = 3
+	loginBackoffBase  = time.Second
+	loginBackoffMax   = 5 * time.Minute
+	loginForget       = 15 * time.Minute
+
+	// loginPruneSize is how many tracked keys trigger dropping the
+	// forgotten ones.
+	loginPruneSize = 1024
+)
+
+// loginBackoff tracks failed logins per remote IP and per user name.
+type loginBackoff struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time // of the last failure
+	until time.Time // before which attempts are refused
+}
+
+func newLoginBackoff() *loginBackoff {
+	return &loginBackoff{failures: make(map[string]*loginFailures)}
+}
+
+// loginKeys returns the backoff keys of a login attempt for user.
+func loginKeys(r *http.Request, user string) []string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return []string{"ip:" + host, "user:" + user}
+}
+
+// wait returns how long an attempt with keys must wait at now, or zero if
+// it may go ahead.
+func (b *loginBackoff) wait(keys []string, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if f := b.failures[key]; f != nil && f.until.Sub(now) > wait {
+			wait = f.until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt with keys at now.
+func (b *loginBackoff) fail(keys []string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.failures) >= loginPruneSize {
+		for key, f := range b.failures {
+			if now.Sub(f.last) > loginForget && !now.Before(f.until) {
+				delete(b.failures, key)
+			}
+		}
+	}
+	for _, key := range keys {
+		f := b.failures[key]
+		if f == nil || now.Sub(f.last) > loginForget {
+			f = &loginFailures{}
+			b.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if n := f.count - loginFreeFailures; n > 0 {
+			delay := loginBackoffMax
+			if n <= 20 && loginBackoffBase<<(n-1) < loginBackoffMax {
+				delay = loginBackoffBase << (n - 1)
+			}
+			f.until = now.Add(delay)
+		}
+	}
+}
+
+// succeed forgets the failures of keys after a successful login.
+func (b *loginBackoff) succeed(keys []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range keys {
+		delete(b.failures, key)
+	}
+}
+
+// LogoutHandler clears the session cookie and redirects to target, from
+// where unauthenticated browsers are sent to log in again.
+func LogoutHandler(cookies *Cookies, target string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cookies.Clear(w, r)
+		http.Redirect(w, r, target, http.StatusSeeOther)
+	})
+}
+
+// localPath returns next if it is a path on this server, or home, so that
+// login redirects cannot send users to another site.
+func localPath(next, home string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return home
+	}
+	return next
+}
+
+func renderLogin(w http.ResponseWriter, status int, next string, failed bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := loginPage.Execute(w, struct {
+		Next      string
+		Failed    bool
+		Throttled bool
+	}{next, failed, status == http.StatusTooManyRequests}); err != nil {
+		slog.Warn("failed to write login page", "error", err)
+	}
+}
@@ -0,0 +1,345 @@
+//go:build linux
+// +build linux
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcStateCookie carries the state, nonce and PKCE verifier of a login
+	// in progress from the login redirect to the callback.
+	oidcStateCookie = "wsconsole_oidc"
+	// oidcLoginTimeout is how long users have to log in at the provider.
+	oidcLoginTimeout = 10 * time.Minute
+	// jwksRefreshInterval limits how often unknown signing keys trigger a
+	// JWKS download, in case the provider rotated its keys.
+	jwksRefreshInterval = time.Minute
+	// maxProviderResponse bounds the documents read from the provider.
+	maxProviderResponse = 1 << 20
+)
+
+// OIDCConfig configures login through an OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer        string   // provider URL; its discovery document is fetched at startup
+	ClientID      string   // client registered with the provider
+	ClientSecret  string   // empty for public clients, which rely on PKCE alone
+	RedirectURL   string   // external URL of the callback handler, as registered
+	Scopes        []string // requested in addition to "openid"
+	UsernameClaim string   // ID token claim used as the user name, "sub" if missing
+	GroupsClaim   string   // ID token claim listing the user's groups
+	HTTPClient    *http.Client
+}
+
+// oidcProvider is the subset of the discovery document that is used.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcFlow is the login state kept in the state cookie.
+type oidcFlow struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Next     string `json:"r"`
+}
+
+// idTokenClaims are the ID token claims checked besides the user claims.
+type idTokenClaims struct {
+	registeredClaims
+	Nonce           string `json:"nonce"`
+	AuthorizedParty string `json:"azp"`
+}
+
+// OIDC logs users in with the OpenID Connect authorization code flow with
+// PKCE. After validating the ID token it issues the same session cookie as
+// the login form, so requests are authenticated by Cookies.
+type OIDC struct {
+	cfg      OIDCConfig
+	cookies  *Cookies
+	provider oidcProvider
+
+	mu          sync.Mutex
+	keys        *KeySet
+	keysFetched time.Time
+}
+
+// NewOIDC discovers the provider at cfg.Issuer and fetches its signing keys.
+func NewOIDC(ctx context.Context, cfg OIDCConfig, cookies *Cookies) (*OIDC, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("OpenID Connect needs an issuer, a client ID and a redirect URL")
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	o := &OIDC{cfg: cfg, cookies: cookies}
+
+	discovery := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := o.getJSON(ctx, discovery, &o.provider); err != nil {
+		return nil, fmt.Errorf("failed to discover OpenID provider: %w", err)
+	}
+	if o.provider.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", o.provider.Issuer, cfg.Issuer)
+	}
+	if o.provider.AuthorizationEndpoint == "" || o.provider.TokenEndpoint == "" || o.provider.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks an authorization, token or JWKS endpoint")
+	}
+	if _, err := o.keySet(ctx, true); err != nil {
+		return nil, err
+	}
+	slog.Info("discovered OpenID provider", "issuer", o.provider.Issuer)
+	return o, nil
+}
+
+func (o *OIDC) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxProviderResponse)).Decode(v)
+}
+
+// keySet returns the provider's signing keys, downloading them again if
+// refresh is set and they were not fetched recently.
+func (o *OIDC) keySet(ctx context.Context, refresh bool) (*KeySet, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.keys != nil && (!refresh || time.Since(o.keysFetched) < jwksRefreshInterval) {
+		return o.keys, nil
+	}
+	var doc json.RawMessage
+	if err := o.getJSON(ctx, o.provider.JWKSURI, &doc); err != nil {
+		return nil, fmt.Errorf("failed to fetch provider keys: %w", err)
+	}
+	keys := &KeySet{}
+	if err := keys.AddJWKS(doc); err != nil {
+		return nil, err
+	}
+	o.keys, o.keysFetched = keys, time.Now()
+	return keys, nil
+}
+
+// LoginHandler redirects the browser to the provider. The next query
+// parameter is where the user returns after logging in.
+func (o *OIDC) LoginHandler(home string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flow := oidcFlow{Next: localPath(r.URL.Query().Get("next"), home)}
+		for _, s := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+			var err error
+			if *s, err = randomToken(); err != nil {
+				slog.Error("failed to start OpenID Connect login", "error", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		value, err := o.cookies.seal(purposeOIDCState, flow, time.Now().Add(oidcLoginTimeout))
+		if err != nil {
+			slog.Error("failed to start OpenID Connect login", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    value,
+			Path:     "/",
+			MaxAge:   int(oidcLoginTimeout.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		challenge := sha256.Sum256([]byte(flow.Verifier))
+		query := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {o.cfg.ClientID},
+			"redirect_uri":          {o.cfg.RedirectURL},
+			"scope":                 {strings.Join(append([]string{"openid"}, o.cfg.Scopes...), " ")},
+			"state":                 {flow.State},
+			"nonce":                 {flow.Nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+		sep := "?"
+		if strings.Contains(o.provider.AuthorizationEndpoint, "?") {
+			sep = "&"
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, o.provider.AuthorizationEndpoint+sep+query.Encode(), http.StatusFound)
+	})
+}
+
+// CallbackHandler completes the login when the provider redirects back:
+// it redeems the code, validates the ID token and issues the session cookie.
+func (o *OIDC) CallbackHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var flow oidcFlow
+		cookie, err := r.Cookie(oidcStateCookie)
+		if err == nil {
+			err = o.cookies.open(purposeOIDCState, cookie.Value, &flow)
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: r.TLS != nil})
+		query := r.URL.Query()
+		if err != nil || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(flow.State)) != 1 {
+			slog.Info("OpenID Connect callback without matching login", "remote", r.RemoteAddr)
+			http.Error(w, "login expired or invalid, please try again", http.StatusBadRequest)
+			return
+		}
+		if e := query.Get("error"); e != "" {
+			slog.Info("OpenID Connect login failed", "remote", r.RemoteAddr, "error", e, "description", query.Get("error_description"))
+			http.Error(w, "login failed", http.StatusUnauthorized)
+			return
+		}
+
+		ident, err := o.redeem(r.Context(), query.Get("code"), flow)
+		if err != nil {
+			slog.Info("OpenID Connect login failed", "remote", r.RemoteAddr, "error", err)
+			http.Error(w, "login failed", http.StatusUnauthorized)
+			return
+		}
+		if err := o.cookies.Issue(w, r, ident); err != nil {
+			slog.Error("failed to issue session cookie", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("login succeeded", "user", ident.Name, "groups", ident.Groups, "method", ident.Method, "remote", r.RemoteAddr)
+		http.Redirect(w, r, flow.Next, http.StatusSeeOther)
+	})
+}
+
+// redeem exchanges code for tokens and returns the identity in the ID token.
+func (o *OIDC) redeem(ctx context.Context, code string, flow oidcFlow) (*Identity, error) {
+	if code == "" {
+		return nil, errors.New("no authorization code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"client_id":     {o.cfg.ClientID},
+		"code_verifier": {flow.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	}
+	resp, err := o.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxProviderResponse)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode token response (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint returned %s: %s", resp.Status, tokens.Error)
+	}
+	return o.verifyIDToken(ctx, tokens.IDToken, flow.Nonce)
+}
+
+// verifyIDToken validates an ID token issued to this client for the login
+// with the given nonce.
+func (o *OIDC) verifyIDToken(ctx context.Context, token, nonce string) (*Identity, error) {
+	keys, err := o.keySet(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	var raw json.RawMessage
+	if err := decodeJWT(token, keys, &raw); err != nil {
+		// The provider may have rotated its keys
+		if keys, err = o.keySet(ctx, true); err != nil {
+			return nil, err
+		}
+		if err := decodeJWT(token, keys, &raw); err != nil {
+			return nil, err
+		}
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed ID token claims", ErrInvalidCredentials)
+	}
+	if err := claims.validate(o.provider.Issuer, o.cfg.ClientID, time.Now()); err != nil {
+		return nil, err
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != o.cfg.ClientID {
+		return nil, fmt.Errorf("%w: ID token authorized for %q", ErrInvalidCredentials, claims.AuthorizedParty)
+	}
+	if claims.Subject == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: ID token subject or nonce mismatch", ErrInvalidCredentials)
+	}
+
+	var user map[string]any
+	if err := json.Unmarshal(raw, &user); err != nil {
+		return nil, fmt.Errorf("%w: malformed ID token claims", ErrInvalidCredentials)
+	}
+	name, _ := user[o.cfg.UsernameClaim].(string)
+	if name == "" {
+		name = claims.Subject
+	}
+	return &Identity{Name: name, Method: "oidc", Groups: stringList(user[o.cfg.GroupsClaim])}, nil
+}
+
+// stringList converts a claim that is a string or an array of strings.
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,212 @@
+//go:build linux
+// +build linux
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockProvider is a minimal OpenID Connect provider that logs in a fixed
+// user without asking.
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	codes    map[string]mockGrant
+	idClaims map[string]any // extra or overriding ID token claims
+}
+
+type mockGrant struct {
+	nonce, challenge, redirect string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key, codes: make(map[string]mockGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "k1", "kty": "RSA",
+			"n": b64.EncodeToString(key.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != "wsconsole" || q.Get("code_challenge_method") != "S256" || q.Get("response_type") != "code" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		code, _ := randomToken()
+		p.mu.Lock()
+		p.codes[code] = mockGrant{nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), redirect: q.Get("redirect_uri")}
+		p.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		grant, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		p.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		id, secret, _ := r.BasicAuth()
+		if !ok || b64.EncodeToString(verifier[:]) != grant.challenge || r.PostFormValue("redirect_uri") != grant.redirect ||
+			id != "wsconsole" || secret != "s3cret" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]any{
+			"iss": p.URL, "aud": "wsconsole", "sub": "u-123", "nonce": grant.nonce,
+			"exp": time.Now().Add(time.Minute).Unix(), "preferred_username": "alice", "groups": []string{"ops", "dev"},
+		}
+		p.mu.Lock()
+		for k, v := range p.idClaims {
+			claims[k] = v
+		}
+		p.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signJWT(t, "RS256", "k1", key, claims), "token_type": "Bearer"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newMockProvider(t)
+	cookies, err := NewCookies(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	var got *Identity
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	})
+	gate := NewGate(cookies)
+	srv := httptest.NewServer(gate.Wrap(mux))
+	defer srv.Close()
+
+	oidc, err := NewOIDC(context.Background(), OIDCConfig{
+		Issuer:       provider.URL,
+		ClientID:     "wsconsole",
+		ClientSecret: "s3cret",
+		RedirectURL:  srv.URL + "/oidc/callback",
+	}, cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle("/oidc/login", oidc.LoginHandler("/"))
+	mux.Handle("/oidc/callback", oidc.CallbackHandler())
+	gate.SetLoginPath("/oidc/login")
+	gate.Allow("/oidc/callback")
+
+	login := func(t *testing.T) *http.Response {
+		t.Helper()
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/term", nil)
+		req.Header.Set("Accept", "text/html")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	got = nil
+	resp := login(t)
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/term" {
+		t.Fatalf("ended at %s with status %d", resp.Request.URL, resp.StatusCode)
+	}
+	if got == nil || got.Name != "alice" || got.Method != "oidc" || len(got.Groups) != 2 || got.Groups[0] != "ops" {
+		t.Fatalf("identity = %+v", got)
+	}
+
+	// ID tokens for another client, or replaying another login's nonce, are rejected
+	for name, claims := range map[string]map[string]any{
+		"audience": {"aud": "other"},
+		"nonce":    {"nonce": "stolen"},
+		"expired":  {"exp": time.Now().Add(-time.Hour).Unix()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			provider.mu.Lock()
+			provider.idClaims = claims
+			provider.mu.Unlock()
+			got = nil
+			if resp := login(t); resp.StatusCode != http.StatusUnauthorized || got != nil {
+				t.Fatalf("status %d, identity %+v", resp.StatusCode, got)
+			}
+		})
+	}
+
+	// The callback is useless without the state cookie of a login in progress
+	resp, err = http.Get(srv.URL + "/oidc/callback?code=x&state=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback without login: status %d", resp.StatusCode)
+	}
+
+	// Anyone can get a state cookie; it is no session cookie
+	resp, err = http.DefaultTransport.RoundTrip(mustRequest(t, srv.URL+"/oidc/login"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var state *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == oidcStateCookie {
+			state = c
+		}
+	}
+	if state == nil {
+		t.Fatal("no state cookie issued")
+	}
+	req := mustRequest(t, srv.URL+"/")
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: state.Value})
+	if id, err := cookies.Authenticate(req); err == nil {
+		t.Fatalf("state cookie accepted as session for %+v", id)
+	}
+}
+
+func mustRequest(t *testing.T, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
@@ -41,6 +41,36 @@ func GetWinsize(fd uintptr) (cols, rows int, err error) {
 	return int(ws.Col), int(ws.Row), nil
 }
 
+// SlaveName returns the path of the slave device of a PTY master, e.g.
+// /dev/pts/3.
+func SlaveName(fd uintptr) (string, error) {
+	n, err := unix.IoctlGetUint32(int(fd), unix.TIOCGPTN)
+	if err != nil {
+		return "", fmt.Errorf("failed to get PTY number: %w", err)
+	}
+	return fmt.Sprintf("/dev/pts/%d", n), nil
+}
+
+// SessionID returns the ID of the session the terminal is the controlling
+// terminal of, i.e. the PID of that session's leader.
+func SessionID(fd uintptr) (int, error) {
+	sid, err := unix.IoctlGetInt(int(fd), unix.TIOCGSID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get terminal session: %w", err)
+	}
+	return sid, nil
+}
+
+// ForegroundProcessGroup returns the foreground process group of the
+// terminal, which receives signals generated by the keyboard.
+func ForegroundProcessGroup(fd uintptr) (int, error) {
+	pgrp, err := unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get foreground process group: %w", err)
+	}
+	return pgrp, nil
+}
+
 // SetNonBlocking sets the PTY file descriptor to non-blocking mode.
 func SetNonBlocking(file *os.File) error {
 	fd := int(file.Fd())
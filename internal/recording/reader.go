@@ -0,0 +1,216 @@
+//go:build linux
+// +build linux
+
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxLineSize bounds a single event line; PTY reads are at most 64KB, which
+// can grow to several times that once JSON escaped.
+const maxLineSize = 1024 * 1024
+
+// ErrInvalidName is returned for names that are not plain recording file names.
+var ErrInvalidName = errors.New("invalid recording name")
+
+// Event is a single asciicast v2 event.
+type Event struct {
+	Time float64 // seconds since the start of the recording
+	Code string  // "o" for output, "r" for resize
+	Data string
+}
+
+// Info describes a stored recording.
+type Info struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Session  string    `json:"session,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Realm    string    `json:"realm,omitempty"`
+	Groups   []string  `json:"groups,omitempty"`
+	Launcher string    `json:"launcher,omitempty"`
+	Start    time.Time `json:"start"`
+}
+
+// List returns the recordings in dir, newest first. Files whose header
+// cannot be read are skipped.
+func List(dir string) ([]Info, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Info{}, nil
+		}
+		return nil, fmt.Errorf("failed to read recording directory: %w", err)
+	}
+
+	infos := []Info{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), FileExt) {
+			continue
+		}
+		info, err := stat(dir, entry.Name())
+		if err != nil {
+			slog.Warn("skipping unreadable recording", "name", entry.Name(), "error", err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Start.After(infos[j].Start)
+	})
+	return infos, nil
+}
+
+func stat(dir, name string) (Info, error) {
+	path := filepath.Join(dir, name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Info{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("failed to close recording", "error", err)
+		}
+	}()
+
+	header, err := readHeader(newScanner(f))
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{
+		Name:     name,
+		Size:     fi.Size(),
+		Modified: fi.ModTime(),
+		Width:    header.Width,
+		Height:   header.Height,
+		Start:    time.Unix(header.Timestamp, 0),
+	}
+	if meta := header.Wsconsole; meta != nil {
+		info.Session = meta.Session
+		info.Remote = meta.Remote
+		info.User = meta.User
+		info.Realm = meta.Realm
+		info.Groups = meta.Groups
+		info.Launcher = meta.Launcher
+		info.Start = meta.Start
+	}
+	return info, nil
+}
+
+// Load reads the named recording from dir.
+func Load(dir, name string) (Header, []Event, error) {
+	if !validName(name) {
+		return Header{}, nil, ErrInvalidName
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return Header{}, nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("failed to close recording", "error", err)
+		}
+	}()
+
+	scanner := newScanner(f)
+	header, err := readHeader(scanner)
+	if err != nil {
+		return Header{}, nil, err
+	}
+
+	var events []Event
+	for scanner.Scan() {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil || len(raw) != 3 {
+			return Header{}, nil, fmt.Errorf("invalid event on line %d", len(events)+2)
+		}
+		var ev Event
+		if err := json.Unmarshal(raw[0], &ev.Time); err != nil {
+			return Header{}, nil, fmt.Errorf("invalid event time on line %d: %w", len(events)+2, err)
+		}
+		if err := json.Unmarshal(raw[1], &ev.Code); err != nil {
+			return Header{}, nil, fmt.Errorf("invalid event code on line %d: %w", len(events)+2, err)
+		}
+		if err := json.Unmarshal(raw[2], &ev.Data); err != nil {
+			return Header{}, nil, fmt.Errorf("invalid event data on line %d: %w", len(events)+2, err)
+		}
+		events = append(events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return Header{}, nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+	return header, events, nil
+}
+
+// Retime converts event times into playback times: gaps longer than maxIdle
+// are shortened to maxIdle (if positive) and the result is divided by speed.
+func Retime(events []Event, speed, maxIdle float64) []Event {
+	if speed <= 0 {
+		speed = 1
+	}
+	out := make([]Event, len(events))
+	var prev, at float64
+	for i, ev := range events {
+		gap := ev.Time - prev
+		if gap < 0 {
+			gap = 0
+		}
+		if maxIdle > 0 && gap > maxIdle {
+			gap = maxIdle
+		}
+		at += gap
+		prev = ev.Time
+		out[i] = Event{Time: at / speed, Code: ev.Code, Data: ev.Data}
+	}
+	return out
+}
+
+func newScanner(f *os.File) *bufio.Scanner {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	return scanner
+}
+
+func readHeader(scanner *bufio.Scanner) (Header, error) {
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return Header{}, fmt.Errorf("failed to read header: %w", err)
+		}
+		return Header{}, errors.New("empty recording")
+	}
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return Header{}, fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Version != 2 {
+		return Header{}, fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+	return header, nil
+}
+
+// validName reports whether name is a plain recording file name, so that
+// client-supplied names cannot escape the recording directory.
+func validName(name string) bool {
+	return name != "" &&
+		filepath.Base(name) == name &&
+		!strings.HasPrefix(name, ".") &&
+		strings.HasSuffix(name, FileExt)
+}
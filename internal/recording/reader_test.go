@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package recording
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetime(t *testing.T) {
+	events := []Event{
+		{Time: 1, Code: "o", Data: "a"},
+		{Time: 11, Code: "o", Data: "b"},
+		{Time: 11.5, Code: "r", Data: "80x24"},
+	}
+	got := Retime(events, 2, 2)
+	want := []float64{0.5, 1.5, 1.75}
+	for i, ev := range got {
+		if ev.Time != want[i] {
+			t.Errorf("event %d time = %v, want %v", i, ev.Time, want[i])
+		}
+	}
+}
+
+func TestListAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now()
+	rec, err := Create(dir, Metadata{Session: "s1", Start: start}, 100, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Output([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := List(dir)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(infos) != 1 || infos[0].Session != "s1" || infos[0].Width != 100 {
+		t.Fatalf("List() = %+v", infos)
+	}
+
+	header, events, err := Load(dir, infos[0].Name)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if header.Height != 30 || len(events) != 1 || events[0].Data != "hello" {
+		t.Fatalf("Load() = %+v, %+v", header, events)
+	}
+}
+
+func TestLoadRejectsPathTraversal(t *testing.T) {
+	for _, name := range []string{"", "../x.cast", "a/b.cast", ".hidden.cast", "x.txt"} {
+		if _, _, err := Load(t.TempDir(), name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Load(%q) error = %v, want ErrInvalidName", name, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+//go:build linux
+// +build linux
+
+// Package recording writes terminal sessions as asciicast v2 files.
+//
+// See https://docs.asciinema.org/manual/asciicast/v2/ for the format: a JSON
+// header line followed by one [time, code, data] event per line.
+package recording
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// FileExt is the extension of recording files.
+	FileExt = ".cast"
+
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// Header is the first line of an asciicast v2 file.
+type Header struct {
+	Version   int       `json:"version"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Timestamp int64     `json:"timestamp"`
+	Title     string    `json:"title,omitempty"`
+	Wsconsole *Metadata `json:"wsconsole,omitempty"` // extension: session metadata
+}
+
+// Metadata describes the recorded session.
+type Metadata struct {
+	Session  string    `json:"session"`
+	Remote   string    `json:"remote,omitempty"`
+	User     string    `json:"user,omitempty"`  // authenticated identity
+	Realm    string    `json:"realm,omitempty"` // the identity's realm, e.g. "htpasswd" or "jwt"
+	Groups   []string  `json:"groups,omitempty"`
+	Launcher string    `json:"launcher,omitempty"`
+	Start    time.Time `json:"start"`
+}
+
+// Recorder appends output and resize events to an asciicast v2 file.
+// It is safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	start   time.Time
+	pending []byte // incomplete UTF-8 sequence carried to the next write
+}
+
+// Create starts a new recording for the session in dir. The initial window
+// size falls back to 80x24 when unknown.
+func Create(dir string, meta Metadata, width, height int) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	if width <= 0 || height <= 0 {
+		width, height = defaultWidth, defaultHeight
+	}
+
+	name := meta.Start.UTC().Format("20060102T150405Z") + "-" + meta.Session + FileExt
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording file: %w", err)
+	}
+
+	r := &Recorder{file: file, start: meta.Start}
+	header := Header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: meta.Start.Unix(),
+		Title:     "wsconsole session " + meta.Session,
+		Wsconsole: &meta,
+	}
+	if err := r.writeLine(header); err != nil {
+		if err := file.Close(); err != nil {
+			slog.Warn("failed to close recording file", "error", err)
+		}
+		return nil, err
+	}
+
+	slog.Info("recording session", "session", meta.Session, "path", path)
+	return r, nil
+}
+
+// Output records terminal output. Multi-byte UTF-8 characters split across
+// calls are joined before being written.
+func (r *Recorder) Output(p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.pending, p...)
+	cut := completeUTF8(data)
+	r.pending = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return nil
+	}
+	return r.writeEvent("o", string(data[:cut]))
+}
+
+// Resize records a terminal window size change.
+func (r *Recorder) Resize(cols, rows int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeEvent("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Close flushes any pending bytes and closes the file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.pending) > 0 {
+		if err := r.writeEvent("o", string(r.pending)); err != nil {
+			slog.Warn("failed to flush recording", "error", err)
+		}
+		r.pending = nil
+	}
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("failed to close recording file: %w", err)
+	}
+	return nil
+}
+
+func (r *Recorder) writeEvent(code, data string) error {
+	elapsed := time.Since(r.start).Seconds()
+	return r.writeLine([]any{elapsed, code, data})
+}
+
+// writeLine writes v as a single JSON line. Each line is written with one
+// system call so a crash never leaves a partial event behind.
+func (r *Recorder) writeLine(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode recording event: %w", err)
+	}
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+	return nil
+}
+
+// completeUTF8 returns the length of the prefix of p that does not end in
+// an incomplete UTF-8 sequence.
+func completeUTF8(p []byte) int {
+	// A UTF-8 sequence is at most 4 bytes, so only the tail needs checking
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(p[i]) {
+			continue
+		}
+		if !utf8.FullRune(p[i:]) {
+			return i
+		}
+		break
+	}
+	return len(p)
+}
@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecorderWritesAsciicast(t *testing.T) {
+	dir := t.TempDir()
+	meta := Metadata{Session: "abc", Remote: "127.0.0.1:1234", Launcher: "direct", Start: time.Now()}
+	rec, err := Create(dir, meta, 0, 0)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	// "é" split across two writes must be recorded as one character
+	if err := rec.Output([]byte("hi \xc3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Output([]byte("\xa9\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Resize(100, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+FileExt))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("recordings = %v, %v", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatalf("invalid header %q: %v", scanner.Text(), err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 {
+		t.Fatalf("header = %+v", header)
+	}
+	if header.Wsconsole == nil || header.Wsconsole.Remote != meta.Remote || header.Wsconsole.Launcher != "direct" {
+		t.Fatalf("header metadata = %+v", header.Wsconsole)
+	}
+
+	var events [][]any
+	for scanner.Scan() {
+		var ev []any
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("invalid event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, ev)
+	}
+	want := [][2]string{{"o", "hi "}, {"o", "é\r\n"}, {"r", "100x30"}}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		if events[i][1] != w[0] || events[i][2] != w[1] {
+			t.Errorf("event %d = %v, want %v", i, events[i], w)
+		}
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"log/slog"
 	"os"
 	"os/exec"
+	"regexp"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 )
@@ -31,8 +33,38 @@ type LoginLauncher interface {
 	Name() string
 }
 
+// FailureDetector is implemented by launchers that can tell their own
+// failures apart from the login process ending, given the exit state of the
+// command returned by Launch and how long it ran.
+type FailureDetector interface {
+	Failed(state *os.ProcessState, ran time.Duration) bool
+}
+
+// LauncherFailed reports whether the command started by launcher ended
+// because the launcher failed rather than login or the user's shell.
+func LauncherFailed(launcher LoginLauncher, state *os.ProcessState, ran time.Duration) bool {
+	d, ok := launcher.(FailureDetector)
+	return ok && state != nil && d.Failed(state, ran)
+}
+
+// PTYForwarder is implemented by launchers that run login on a PTY of
+// their own and forward its I/O, like systemd-run --pty. The user's login
+// session then never appears on the PTY passed to Launch.
+type PTYForwarder interface {
+	ForwardsPTY() bool
+}
+
+// LoginOnPTY reports whether the user's login session runs on the PTY
+// passed to launcher's Launch, where its processes can be found.
+func LoginOnPTY(launcher LoginLauncher) bool {
+	f, ok := launcher.(PTYForwarder)
+	return !ok || !f.ForwardsPTY()
+}
+
 // DirectLauncher directly forks /bin/login (requires UID=0)
-type DirectLauncher struct{}
+type DirectLauncher struct {
+	User string // if set, login only prompts for this user's password
+}
 
 func (l *DirectLauncher) Name() string {
 	return "direct"
@@ -42,7 +74,7 @@ func (l *DirectLauncher) Launch(ctx context.Context, slave *os.File) (*exec.Cmd,
 	if os.Getuid() != 0 {
 		return nil, fmt.Errorf("direct launcher requires UID=0")
 	}
-	cmd := exec.CommandContext(ctx, "/bin/login")
+	cmd := exec.CommandContext(ctx, "/bin/login", loginArgs(l.User)...)
 	cmd.Stdin = slave
 	cmd.Stdout = slave
 	cmd.Stderr = slave
@@ -54,15 +86,16 @@ func (l *DirectLauncher) Launch(ctx context.Context, slave *os.File) (*exec.Cmd,
 }
 
 // SystemdRunLauncher uses systemd-run to escalate privileges and launch /bin/login
-type SystemdRunLauncher struct{}
+type SystemdRunLauncher struct {
+	User string // if set, login only prompts for this user's password
+}
 
 func (l *SystemdRunLauncher) Name() string {
 	return "systemd-run"
 }
 
 func (l *SystemdRunLauncher) Launch(ctx context.Context, slave *os.File) (*exec.Cmd, error) {
-	cmd := exec.CommandContext(ctx,
-		"systemd-run",
+	args := []string{
 		"--uid=0",
 		"--pty",
 		"--quiet",
@@ -70,7 +103,8 @@ func (l *SystemdRunLauncher) Launch(ctx context.Context, slave *os.File) (*exec.
 		"--wait",
 		"--service-type=exec",
 		"/bin/login",
-	)
+	}
+	cmd := exec.CommandContext(ctx, "systemd-run", append(args, loginArgs(l.User)...)...)
 	cmd.Stdin = slave
 	cmd.Stdout = slave
 	cmd.Stderr = slave
@@ -81,6 +115,60 @@ func (l *SystemdRunLauncher) Launch(ctx context.Context, slave *os.File) (*exec.
 	return cmd, nil
 }
 
+// systemdRunStartup is how soon after starting systemd-run an unsuccessful
+// exit is blamed on systemd-run itself (e.g. a polkit denial), since login
+// cannot fail that quickly once a user is at the prompt.
+const systemdRunStartup = time.Second
+
+// Exit statuses 200-243 are set by the service manager when it cannot set up
+// the service, e.g. 203 when /bin/login cannot be executed.
+const (
+	systemdExitFirst = 200
+	systemdExitLast  = 243
+)
+
+// Failed implements FailureDetector.
+func (l *SystemdRunLauncher) Failed(state *os.ProcessState, ran time.Duration) bool {
+	code := state.ExitCode()
+	if code >= systemdExitFirst && code <= systemdExitLast {
+		return true
+	}
+	return code > 0 && ran < systemdRunStartup
+}
+
+// ForwardsPTY implements PTYForwarder: systemd-run --pty runs login on a
+// PTY allocated by the service manager.
+func (l *SystemdRunLauncher) ForwardsPTY() bool {
+	return true
+}
+
+// validUserName matches the portable user names accepted by useradd, so a
+// name can never be mistaken for a login option.
+var validUserName = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,31}$`)
+
+func loginArgs(user string) []string {
+	if user == "" {
+		return nil
+	}
+	return []string{user}
+}
+
+// LoginAs returns a launcher that starts login for user instead of asking
+// for a user name. The password is still required.
+func LoginAs(launcher LoginLauncher, user string) (LoginLauncher, error) {
+	if !validUserName.MatchString(user) {
+		return nil, fmt.Errorf("invalid login user name %q", user)
+	}
+	switch l := launcher.(type) {
+	case *DirectLauncher:
+		return &DirectLauncher{User: user}, nil
+	case *SystemdRunLauncher:
+		return &SystemdRunLauncher{User: user}, nil
+	default:
+		return nil, fmt.Errorf("launcher %s does not support a login user", l.Name())
+	}
+}
+
 // SelectLauncher determines the best LoginLauncher based on environment and permissions
 func SelectLauncher(strategy LoginStrategy) (LoginLauncher, error) {
 	if strategy != StrategyAuto {
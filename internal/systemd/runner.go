@@ -17,25 +17,25 @@ import (
 //
 // Returns the command, PTY master file descriptor, cleanup function, and error.
 func RunLoginPTY(ctx context.Context, strategy LoginStrategy) (cmd *exec.Cmd, ptyMaster *os.File, cleanup func() error, err error) {
-	// Create a PTY master/slave pair
-	master, slave, err := openPTY()
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to open PTY: %w", err)
-	}
-
 	// Select launcher strategy
 	launcher, err := SelectLauncher(strategy)
 	if err != nil {
-		if err := master.Close(); err != nil {
-
-			slog.Warn("failed to close master", "error", err)
-
-		}
-		if err := slave.Close(); err != nil {
-			slog.Warn("failed to close slave", "error", err)
-		}
 		return nil, nil, nil, fmt.Errorf("failed to select launcher: %w", err)
 	}
+	return StartLoginPTY(ctx, launcher)
+}
+
+// StartLoginPTY spawns a login shell on a new PTY using the given launcher.
+// Use it instead of RunLoginPTY when the caller needs to know which launcher
+// was selected.
+//
+// Returns the command, PTY master file descriptor, cleanup function, and error.
+func StartLoginPTY(ctx context.Context, launcher LoginLauncher) (cmd *exec.Cmd, ptyMaster *os.File, cleanup func() error, err error) {
+	// Create a PTY master/slave pair
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open PTY: %w", err)
+	}
 
 	slog.Debug("using launcher strategy", "strategy", launcher.Name())
 
@@ -4,7 +4,11 @@
 package systemd
 
 import (
+	"context"
+	"os/exec"
+	"strconv"
 	"testing"
+	"time"
 )
 
 // Placeholder test to satisfy go test
@@ -13,3 +17,55 @@ func TestPlaceholder(t *testing.T) {
 	// TODO: Add proper systemd-run tests
 	t.Log("systemd-run tests not yet implemented")
 }
+
+func TestLoginAs(t *testing.T) {
+	l, err := LoginAs(&SystemdRunLauncher{}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := l.Launch(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cmd.Args[len(cmd.Args)-2:]; got[0] != "/bin/login" || got[1] != "alice" {
+		t.Errorf("args end with %q, want /bin/login alice", got)
+	}
+
+	for _, user := range []string{"", "-f", "root -f", "Alice"} {
+		if _, err := LoginAs(&DirectLauncher{}, user); err == nil {
+			t.Errorf("LoginAs(%q) succeeded", user)
+		}
+	}
+}
+
+func TestSystemdRunFailed(t *testing.T) {
+	for _, tt := range []struct {
+		code   int
+		ran    time.Duration
+		failed bool
+	}{
+		{0, 0, false},                 // logged out right away
+		{1, 0, true},                  // e.g. polkit denial
+		{1, time.Minute, false},       // the shell exited with status 1
+		{203, time.Minute, true},      // /bin/login could not be executed
+		{130, time.Millisecond, true}, // interrupted before login started
+	} {
+		cmd := exec.Command("sh", "-c", "exit "+strconv.Itoa(tt.code))
+		cmd.Run()
+		if got := LauncherFailed(&SystemdRunLauncher{}, cmd.ProcessState, tt.ran); got != tt.failed {
+			t.Errorf("exit %d after %v: failed = %v, want %v", tt.code, tt.ran, got, tt.failed)
+		}
+		if LauncherFailed(&DirectLauncher{}, cmd.ProcessState, tt.ran) {
+			t.Errorf("exit %d: direct launcher reported as failed", tt.code)
+		}
+	}
+}
+
+func TestLoginOnPTY(t *testing.T) {
+	if !LoginOnPTY(&DirectLauncher{}) {
+		t.Error("direct login reported as off the PTY")
+	}
+	if LoginOnPTY(&SystemdRunLauncher{}) {
+		t.Error("systemd-run login reported on the PTY")
+	}
+}
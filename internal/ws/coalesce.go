@@ -0,0 +1,120 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultCoalesceDelay is the default upper bound on how long output is
+	// held back to merge it with following PTY reads.
+	DefaultCoalesceDelay = 5 * time.Millisecond
+	// DefaultCoalesceBytes is the default frame size at which merged output
+	// is sent without waiting for the delay to expire.
+	DefaultCoalesceBytes = 32 * 1024
+)
+
+// coalescer merges bursts of PTY reads into fewer WebSocket frames.
+//
+// Output arriving after a quiet period is sent at once, so interactive echo
+// is not delayed. Output arriving within delay of the previous frame is part
+// of a burst (e.g. a full-screen redraw by top) and is held for at most
+// delay, or until limit bytes have accumulated, before being framed.
+type coalescer struct {
+	delay time.Duration
+	limit int
+	stats *outputStats
+
+	buf  []byte
+	last time.Time // when the previous frame was sent
+}
+
+// newCoalescer returns a coalescer for one output stream. A zero delay
+// disables merging but still counts frames.
+func newCoalescer(cfg Config, stats *outputStats) *coalescer {
+	limit := cfg.CoalesceBytes
+	if limit <= 0 {
+		limit = DefaultCoalesceBytes
+	}
+	return &coalescer{delay: cfg.CoalesceDelay, limit: limit, stats: stats}
+}
+
+// gather returns first merged with the reads that follow it on sub.out.
+// max caps the merged size (e.g. the remaining flow control credit). eof
+// reports that the output channel was closed while gathering; the returned
+// data must still be sent. The returned slice is only valid until the next call.
+func (c *coalescer) gather(ctx context.Context, sub *subscriber, first []byte, max int64) (data []byte, eof bool) {
+	reads := 1
+	defer func() {
+		c.last = time.Now()
+		c.stats.record(reads, len(data))
+	}()
+
+	limit := int64(c.limit)
+	if max < limit {
+		limit = max
+	}
+	if c.delay <= 0 || int64(len(first)) >= limit || time.Since(c.last) >= c.delay {
+		return first, false
+	}
+
+	c.buf = append(c.buf[:0], first...)
+	timer := time.NewTimer(c.delay)
+	defer timer.Stop()
+	for int64(len(c.buf)) < limit {
+		select {
+		case next, ok := <-sub.out:
+			if !ok {
+				return c.buf, true
+			}
+			c.buf = append(c.buf, next...)
+			reads++
+		case <-timer.C:
+			return c.buf, false
+		case <-sub.closed:
+			return c.buf, false
+		case <-ctx.Done():
+			return c.buf, false
+		}
+	}
+	return c.buf, false
+}
+
+// outputStats counts PTY reads and the frames they were sent in.
+type outputStats struct {
+	reads  atomic.Uint64
+	frames atomic.Uint64
+	bytes  atomic.Uint64
+}
+
+func (s *outputStats) record(reads, n int) {
+	if s == nil {
+		return
+	}
+	s.reads.Add(uint64(reads))
+	s.frames.Add(1)
+	s.bytes.Add(uint64(n))
+}
+
+// Stats is a snapshot of the handler's output counters.
+type Stats struct {
+	OutputReads  uint64 `json:"output_reads"`  // PTY reads forwarded to clients
+	OutputFrames uint64 `json:"output_frames"` // WebSocket frames carrying those reads
+	OutputBytes  uint64 `json:"output_bytes"`
+	FramesSaved  uint64 `json:"frames_saved"` // frames avoided by coalescing
+
+	Sessions []SessionStats `json:"sessions"`
+}
+
+func (s *outputStats) snapshot() Stats {
+	reads, frames := s.reads.Load(), s.frames.Load()
+	stats := Stats{OutputReads: reads, OutputFrames: frames, OutputBytes: s.bytes.Load()}
+	if reads > frames {
+		stats.FramesSaved = reads - frames
+	}
+	return stats
+}
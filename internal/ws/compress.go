@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultCompressionLevel favours speed; terminal output compresses well
+	// even at the lowest level.
+	DefaultCompressionLevel = flate.BestSpeed
+	// DefaultCompressionMinSize is the smallest message worth compressing.
+	// Below it the deflate overhead outweighs the savings (e.g. keystroke echo).
+	DefaultCompressionMinSize = 256
+)
+
+// compressionOffered reports whether the client offered permessage-deflate.
+// The upgrader accepts the offer whenever compression is enabled.
+func compressionOffered(r *http.Request) bool {
+	for _, ext := range r.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// upgrade switches the request to a WebSocket connection, negotiating
+// permessage-deflate when enabled in the configuration. Bytes written to the
+// network are counted so that compression savings can be reported.
+// The negotiated subprotocol proto is echoed to the client unless it is
+// protocolLegacy.
+func (h *Handler) upgrade(w http.ResponseWriter, r *http.Request, proto string) (*wsConn, error) {
+	u := upgrader
+	u.CheckOrigin = h.cfg.Origins.allowed
+	u.EnableCompression = h.cfg.Compression
+
+	var header http.Header
+	if proto != protocolLegacy {
+		header = http.Header{"Sec-Websocket-Protocol": {proto}}
+	}
+	counter := &countingResponseWriter{ResponseWriter: w}
+	ws, err := u.Upgrade(counter, r, header)
+	if err != nil {
+		return nil, err
+	}
+	conn := &wsConn{Conn: ws, wire: counter.conn}
+	if h.cfg.Compression && compressionOffered(r) {
+		if err := ws.SetCompressionLevel(h.cfg.CompressionLevel); err != nil {
+			slog.Warn("invalid compression level, using default", "level", h.cfg.CompressionLevel, "error", err)
+		}
+		conn.compressMin = h.cfg.CompressionMinSize
+		conn.compressed = true
+	}
+	return conn, nil
+}
+
+// countingResponseWriter hands the WebSocket upgrader a connection that
+// counts the bytes written to the network.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+// Hijack implements http.Hijacker.
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &countingConn{Conn: conn}
+	return w.conn, brw, nil
+}
+
+// countingConn counts bytes written to a network connection.
+type countingConn struct {
+	net.Conn
+	written atomic.Uint64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+// compressionStats counts a session's output before and after compression.
+// Wire bytes include WebSocket framing, so they can exceed raw bytes on an
+// uncompressed connection.
+type compressionStats struct {
+	raw  atomic.Uint64
+	wire atomic.Uint64
+}
+
+func (s *compressionStats) record(raw, wire int) {
+	if s == nil {
+		return
+	}
+	s.raw.Add(uint64(raw))
+	s.wire.Add(uint64(wire))
+}
+
+// SessionStats describes the output of one live session. Sessions the
+// requester did not start only carry the launcher, start time and byte
+// counts (see Handler.Stats).
+type SessionStats struct {
+	Session   string    `json:"session,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Groups    []string  `json:"groups,omitempty"`
+	Launcher  string    `json:"launcher,omitempty"`
+	Started   time.Time `json:"started"`
+	RawBytes  uint64    `json:"raw_bytes"`  // output messages before compression
+	WireBytes uint64    `json:"wire_bytes"` // the same messages as sent on the network
+
+	// Reported by the shell with OSC sequences, see osc.go
+	Title      string `json:"title,omitempty"`
+	Cwd        string `json:"cwd,omitempty"`
+	Activity   string `json:"activity,omitempty"`    // "prompt" or "running"
+	LastStatus *int   `json:"last_status,omitempty"` // exit status of the last command
+}
@@ -0,0 +1,73 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sys/unix"
+)
+
+// exitStatus describes how a session's login process ended.
+type exitStatus struct {
+	code           *int   // nil if the process was killed by a signal
+	signal         string // the terminating signal without "SIG", e.g. "TERM"
+	launcherFailed bool   // the launcher failed rather than login or the shell
+	launcher       string
+}
+
+// newExitStatus interprets the state of a reaped login process.
+func newExitStatus(state *os.ProcessState, launcher string, launcherFailed bool) *exitStatus {
+	e := &exitStatus{launcher: launcher, launcherFailed: launcherFailed}
+	if state == nil {
+		return e
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		e.signal = strings.TrimPrefix(unix.SignalName(ws.Signal()), "SIG")
+		if e.signal == "" {
+			e.signal = fmt.Sprint(int(ws.Signal()))
+		}
+		return e
+	}
+	if code := state.ExitCode(); code >= 0 {
+		e.code = &code
+	}
+	return e
+}
+
+// message returns the "exit" message reporting e. A nil status (the
+// process could not be reaped) reports no code.
+func (e *exitStatus) message() Message {
+	if e == nil {
+		return Message{Type: "exit"}
+	}
+	return Message{Type: "exit", Code: e.code, Signal: e.signal, LauncherFailed: e.launcherFailed, Launcher: e.launcher}
+}
+
+// reason returns the close reason reporting e.
+func (e *exitStatus) reason() string {
+	switch {
+	case e == nil:
+		return "PTY closed"
+	case e.launcherFailed:
+		return closeReasonLauncherFailed
+	case e.signal != "":
+		return "killed by signal " + e.signal
+	case e.code != nil:
+		return fmt.Sprintf("exited with status %d", *e.code)
+	}
+	return "PTY closed"
+}
+
+// closeCode returns the WebSocket close code reporting e.
+func (e *exitStatus) closeCode() int {
+	if e != nil && e.launcherFailed {
+		return closeLauncherFailed
+	}
+	return websocket.CloseNormalClosure
+}
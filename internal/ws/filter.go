@@ -0,0 +1,377 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClipboardPolicy decides what happens to OSC 52 sequences in the output,
+// with which any program, or a file being cat-ed, could otherwise read or
+// write the browser clipboard.
+type ClipboardPolicy string
+
+const (
+	ClipboardAllow   ClipboardPolicy = "allow"   // pass OSC 52 to the terminal
+	ClipboardStrip   ClipboardPolicy = "strip"   // remove OSC 52 from the output
+	ClipboardConfirm ClipboardPolicy = "confirm" // remove it and send a "clipboard" message the client must confirm
+)
+
+// ParseClipboardPolicy validates a -clipboard value.
+func ParseClipboardPolicy(s string) (ClipboardPolicy, error) {
+	switch p := ClipboardPolicy(s); p {
+	case ClipboardAllow, ClipboardStrip, ClipboardConfirm:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown clipboard policy %q (want allow, strip or confirm)", s)
+}
+
+// QueryPolicy decides what happens to query sequences whose replies are
+// sent back as input and can carry text a program chose, such as the
+// window title report (CSI 21 t) and DECRQSS (DCS $ q ... ST).
+type QueryPolicy string
+
+const (
+	QueriesAllow QueryPolicy = "allow" // pass queries to the terminal
+	QueriesStrip QueryPolicy = "strip" // remove them from the output
+)
+
+// ParseQueryPolicy validates a -terminal-queries value.
+func ParseQueryPolicy(s string) (QueryPolicy, error) {
+	switch p := QueryPolicy(s); p {
+	case QueriesAllow, QueriesStrip:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown terminal query policy %q (want allow or strip)", s)
+}
+
+const (
+	// maxClipboardSize caps an OSC 52 sequence held back for inspection;
+	// longer ones are dropped.
+	maxClipboardSize = 1 << 20
+	// maxHeldSequence caps the other sequences held back until it is
+	// known whether they must be removed.
+	maxHeldSequence = 64
+	// heldSequenceTimeout is how long the start of a sequence may wait for
+	// the rest once the PTY has nothing more to read. It is then dropped,
+	// since releasing it could complete a removed sequence on the terminal.
+	heldSequenceTimeout = 250 * time.Millisecond
+)
+
+type filterState int
+
+const (
+	filterGround  filterState = iota
+	filterIntro               // after ESC or the first byte of a UTF-8 C1 control
+	filterOSC                 // reading the OSC command number
+	filterCSI                 // reading a CSI sequence
+	filterDCS                 // checking a DCS for "$q"
+	filterString              // holding an OSC 52 or DECRQSS string until its terminator
+	filterDiscard             // dropping an overlong string until its terminator
+)
+
+// UTF-8 encodings of the C1 controls that xterm.js also accepts as
+// introducers: 0xC2 followed by one of these.
+const (
+	utf8C1 = 0xc2
+	c1DCS  = 0x90
+	c1CSI  = 0x9b
+	c1ST   = 0x9c
+	c1OSC  = 0x9d
+)
+
+const (
+	introLen = 2    // ESC ] and the UTF-8 encoding of C1 OSC are both 2 bytes
+	oscClip  = "52" // the OSC command number for the clipboard
+)
+
+// outputFilter removes or converts OSC 52 and dangerous query sequences in
+// the output of one connection. Sequences may be split across reads, so
+// the start of a candidate sequence is held back until it is known whether
+// it must be removed; everything else passes through unchanged.
+type outputFilter struct {
+	clipboard ClipboardPolicy
+	queries   QueryPolicy
+
+	state   filterState
+	held    []byte // the sequence being examined, not yet written out
+	prev    byte   // previous byte of a held string, to find ESC \ and C1 ST
+	decrqss bool   // the held string is DECRQSS rather than OSC 52
+
+	out    []byte
+	events []Message
+}
+
+// newOutputFilter returns a filter applying cfg's policies, or nil if
+// output passes unchanged.
+func newOutputFilter(cfg Config) *outputFilter {
+	clipboard, queries := cfg.Clipboard, cfg.TerminalQueries
+	if (clipboard == "" || clipboard == ClipboardAllow) && (queries == "" || queries == QueriesAllow) {
+		return nil
+	}
+	return &outputFilter{clipboard: clipboard, queries: queries}
+}
+
+func (f *outputFilter) stripClipboard() bool {
+	return f.clipboard == ClipboardStrip || f.clipboard == ClipboardConfirm
+}
+
+func (f *outputFilter) stripQueries() bool {
+	return f.queries == QueriesStrip
+}
+
+// filter returns data without the removed sequences, and the "clipboard"
+// messages for OSC 52 sequences under ClipboardConfirm. A nil filter
+// returns data unchanged. The results are only valid until the next call.
+func (f *outputFilter) filter(data []byte) ([]byte, []Message) {
+	if f == nil {
+		return data, nil
+	}
+	f.out = f.out[:0]
+	f.events = f.events[:0]
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch f.state {
+		case filterGround:
+			j := indexIntroducer(data[i:])
+			if j < 0 {
+				f.out = append(f.out, data[i:]...)
+				return f.out, f.events
+			}
+			f.out = append(f.out, data[i:i+j]...)
+			i += j
+			f.held = append(f.held[:0], data[i])
+			f.state = filterIntro
+		case filterIntro:
+			switch introduced(f.held[0], c) {
+			case ']':
+				f.hold(c, filterOSC)
+			case '[':
+				if !f.stripQueries() {
+					f.release()
+					i--
+					continue
+				}
+				f.hold(c, filterCSI)
+			case 'P':
+				if !f.stripQueries() {
+					f.release()
+					i--
+					continue
+				}
+				f.hold(c, filterDCS)
+			default:
+				// Not a sequence we filter; c may start one
+				f.release()
+				i--
+			}
+		case filterOSC:
+			switch {
+			case c >= '0' && c <= '9' && len(f.held) < maxHeldSequence:
+				f.held = append(f.held, c)
+			case c == ';' && string(f.held[introLen:]) == oscClip && f.stripClipboard():
+				f.held = append(f.held, c)
+				f.decrqss = false
+				f.prev = 0
+				f.state = filterString
+			default:
+				f.release()
+				i--
+			}
+		case filterCSI:
+			switch {
+			case c >= 0x20 && c <= 0x3f && len(f.held) < maxHeldSequence:
+				f.held = append(f.held, c) // parameters and intermediates
+			case c >= 0x40 && c <= 0x7e:
+				f.held = append(f.held, c) // final byte
+				if isTitleReport(f.held[introLen:]) {
+					slog.Debug("removed title report query from output")
+					f.held = f.held[:0]
+					f.state = filterGround
+				} else {
+					f.release()
+				}
+			default:
+				f.release()
+				i--
+			}
+		case filterDCS:
+			switch {
+			case c == '$' && len(f.held) == introLen:
+				f.held = append(f.held, c)
+			case c == 'q' && len(f.held) == introLen+1:
+				slog.Debug("removed DECRQSS query from output")
+				f.held = append(f.held, c)
+				f.decrqss = true
+				f.prev = 0
+				f.state = filterString
+			default:
+				f.release()
+				i--
+			}
+		case filterString, filterDiscard:
+			if f.endString(c) {
+				i-- // c starts a new sequence or is executed by the terminal
+			}
+		}
+	}
+	return f.out, f.events
+}
+
+// pending reports whether the start of a sequence is held back waiting
+// for the rest. Held OSC 52 and DECRQSS strings do not count: the terminal
+// would swallow them until their terminator, too.
+func (f *outputFilter) pending() bool {
+	if f == nil {
+		return false
+	}
+	switch f.state {
+	case filterIntro, filterOSC, filterCSI, filterDCS:
+		return true
+	}
+	return false
+}
+
+// expire drops a pending sequence whose rest did not arrive within
+// heldSequenceTimeout; what follows is treated as ordinary output.
+func (f *outputFilter) expire() {
+	if !f.pending() {
+		return
+	}
+	slog.Debug("dropping incomplete sequence from output", "size", len(f.held))
+	f.held = f.held[:0]
+	f.state = filterGround
+}
+
+// hold adds c to the held sequence and moves to state.
+func (f *outputFilter) hold(c byte, state filterState) {
+	f.held = append(f.held, c)
+	f.state = state
+}
+
+// release writes out the held bytes, which turned out not to need filtering.
+func (f *outputFilter) release() {
+	f.out = append(f.out, f.held...)
+	f.held = f.held[:0]
+	f.state = filterGround
+}
+
+// endString handles byte c of a held or discarded string. It returns true
+// if the string was aborted and c must be processed again.
+func (f *outputFilter) endString(c byte) (again bool) {
+	prev := f.prev
+	f.prev = c
+	switch {
+	case c == asciiBEL:
+		f.finishString(len(f.held))
+	case prev == asciiESC && c == '\\':
+		f.finishString(len(f.held) - 1)
+	case prev == utf8C1 && c == c1ST:
+		f.finishString(len(f.held) - 1)
+	case prev == asciiESC, prev == utf8C1 && (c == c1OSC || c == c1CSI || c == c1DCS):
+		// A new sequence aborts the string
+		f.state = filterIntro
+		f.held = append(f.held[:0], prev)
+		return true
+	case c == asciiCAN || c == asciiSUB:
+		f.held = f.held[:0]
+		f.state = filterGround
+		return true
+	case f.state == filterDiscard:
+		// Only the terminator matters
+	case len(f.held) >= maxClipboardSize:
+		slog.Debug("dropping overlong sequence from output", "size", len(f.held))
+		f.state = filterDiscard
+		f.held = f.held[:0]
+	default:
+		f.held = append(f.held, c)
+	}
+	return false
+}
+
+// finishString removes the string held up to end and, for OSC 52 under
+// ClipboardConfirm, queues a "clipboard" message.
+func (f *outputFilter) finishString(end int) {
+	held := f.held
+	f.held = f.held[:0]
+	discarded := f.state == filterDiscard
+	f.state = filterGround
+	if discarded || f.decrqss || f.clipboard != ClipboardConfirm || end < introLen {
+		return
+	}
+	body := string(held[introLen:end])
+	if msg, ok := parseClipboard(strings.TrimPrefix(body, oscClip+";")); ok {
+		f.events = append(f.events, msg)
+	}
+}
+
+// parseClipboard converts the parameters of OSC 52, "<selection>;<data>",
+// to a "clipboard" message. Data "?" asks for the clipboard contents;
+// otherwise it is base64 text to copy.
+func parseClipboard(params string) (Message, bool) {
+	selection, data, ok := strings.Cut(params, ";")
+	if !ok {
+		return Message{}, false
+	}
+	if selection == "" {
+		selection = "c"
+	}
+	if data == "?" {
+		return Message{Type: "clipboard", Action: "read", Selection: selection}, true
+	}
+	text, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		slog.Debug("ignoring malformed OSC 52 data", "error", err)
+		return Message{}, false
+	}
+	return Message{Type: "clipboard", Action: "write", Selection: selection, Payload: text}, true
+}
+
+// indexIntroducer returns the index of the first byte that may start a
+// filtered sequence, or -1.
+func indexIntroducer(data []byte) int {
+	for i, c := range data {
+		if c == asciiESC || c == utf8C1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// introduced returns ']', '[' or 'P' if lead followed by c introduces an
+// OSC, CSI or DCS, or 0.
+func introduced(lead, c byte) byte {
+	if lead == asciiESC {
+		switch c {
+		case ']', '[', 'P':
+			return c
+		}
+		return 0
+	}
+	switch c {
+	case c1OSC:
+		return ']'
+	case c1CSI:
+		return '['
+	case c1DCS:
+		return 'P'
+	}
+	return 0
+}
+
+// isTitleReport reports whether a CSI sequence (without its introducer)
+// asks for the icon label or window title: CSI 20 t or CSI 21 t.
+func isTitleReport(seq []byte) bool {
+	if len(seq) == 0 || seq[len(seq)-1] != 't' {
+		return false
+	}
+	first, _, _ := strings.Cut(string(seq[:len(seq)-1]), ";")
+	n, err := strconv.Atoi(first)
+	return err == nil && (n == 20 || n == 21)
+}
@@ -0,0 +1,180 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// DefaultFlowWindow is the default upper bound on unacknowledged output
+// bytes a client may negotiate.
+const DefaultFlowWindow = 256 * 1024
+
+// minFlowWindow keeps a tiny negotiated window from degenerating into one
+// round trip per PTY read.
+const minFlowWindow = 4 * 1024
+
+// flowControl implements credit-based flow control for one output stream.
+//
+// A client opts in by requesting a window (?flow=<bytes>, or "window" in a
+// multiplexed "open"). The server then stops forwarding output once the
+// window is full of unacknowledged bytes, and resumes as the client sends
+// {"type":"ack","bytes":N} for the output it has consumed. While paused the
+// session stops reading the PTY, so a runaway program blocks on its own
+// writes instead of the WebSocket timing out. File downloads share the
+// window with the terminal output.
+type flowControl struct {
+	window int64
+
+	mu      sync.Mutex
+	unacked int64
+	held    bool          // paused explicitly by the client
+	wake    chan struct{} // closed and replaced when credit is returned
+}
+
+// negotiateFlow returns the window to use for a requested size, raised to
+// minFlowWindow and capped by the server maximum, which wins when it is
+// the smaller. It returns 0 when flow control is off.
+func negotiateFlow(requested, max int64) int64 {
+	if requested <= 0 || max <= 0 {
+		return 0
+	}
+	if requested < minFlowWindow {
+		requested = minFlowWindow
+	}
+	if requested > max {
+		requested = max
+	}
+	return requested
+}
+
+// flowFromRequest negotiates flow control from the ?flow= query parameter.
+func flowFromRequest(r *http.Request, max int64) *flowControl {
+	requested, err := strconv.ParseInt(r.URL.Query().Get("flow"), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return newFlowControl(negotiateFlow(requested, max))
+}
+
+// newFlowControl returns nil, meaning unlimited, for a zero window.
+func newFlowControl(window int64) *flowControl {
+	if window <= 0 {
+		return nil
+	}
+	return &flowControl{
+		window: window,
+		wake:   make(chan struct{}),
+	}
+}
+
+// newManualFlow returns flow control without a window, for protocols whose
+// clients pause and resume output explicitly (see hold).
+func newManualFlow() *flowControl {
+	return &flowControl{
+		window: math.MaxInt64,
+		wake:   make(chan struct{}),
+	}
+}
+
+// hold pauses output until it is called again with false.
+func (f *flowControl) hold(paused bool) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.held = paused
+	f.wakeLocked()
+	f.mu.Unlock()
+}
+
+// sent records n bytes written to the client.
+func (f *flowControl) sent(n int) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.unacked += int64(n)
+	f.mu.Unlock()
+}
+
+// ack releases n bytes of credit and wakes a paused sender.
+func (f *flowControl) ack(n int64) {
+	if f == nil || n <= 0 {
+		return
+	}
+	f.mu.Lock()
+	f.unacked -= n
+	if f.unacked < 0 {
+		f.unacked = 0
+	}
+	f.wakeLocked()
+	f.mu.Unlock()
+}
+
+// wakeLocked wakes every sender waiting on resumed. Callers must hold f.mu.
+func (f *flowControl) wakeLocked() {
+	close(f.wake)
+	f.wake = make(chan struct{})
+}
+
+// paused reports whether the window is full.
+func (f *flowControl) paused() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.held || f.unacked >= f.window
+}
+
+// available returns the credit left in the window, which is unlimited when
+// flow control is off.
+func (f *flowControl) available() int64 {
+	if f == nil {
+		return math.MaxInt64
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.window - f.unacked
+}
+
+// resumed returns the channel closed when credit is next returned. It is
+// nil, and so never ready, when flow control is off. Senders get it before
+// checking paused, so that no credit returned in between is missed.
+func (f *flowControl) resumed() <-chan struct{} {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.wake
+}
+
+// wait blocks until the window has room or ctx is done.
+func (f *flowControl) wait(ctx context.Context) error {
+	for {
+		resumed := f.resumed()
+		if !f.paused() {
+			return nil
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// size returns the negotiated window, or 0 when flow control is off.
+func (f *flowControl) size() int64 {
+	if f == nil {
+		return 0
+	}
+	return f.window
+}
@@ -6,48 +6,271 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
 	"sync"
 	"time"
 
-	"github.com/danmaid/wsconsole/internal/pty"
+	"github.com/danmaid/wsconsole/internal/auth"
 	"github.com/danmaid/wsconsole/internal/systemd"
 	"github.com/gorilla/websocket"
 )
 
 // Message represents the WebSocket JSON message protocol (optional mode).
+//
+// Client to server: "data" (terminal input) and "resize".
+// Server to client: "session", "data" (terminal output), "exit", "error",
+// and "join"/"leave" when read-only viewers come and go.
+// Multiplexed mode adds "open", "close", "opened" and "closed" (see mux.go).
 type Message struct {
-	Type string `json:"type"`           // "resize"
-	Cols int    `json:"cols,omitempty"` // for "resize" type
-	Rows int    `json:"rows,omitempty"` // for "resize" type
+	Type     string  `json:"type"`               // "hello", "data", "resize", "signal", "session", "exit", "error"
+	Channel  uint32  `json:"channel,omitempty"`  // multiplexed mode channel ID
+	Payload  []byte  `json:"payload,omitempty"`  // for "data" type, base64 encoded on the wire
+	Cols     int     `json:"cols,omitempty"`     // for "resize" and "hello" types
+	Rows     int     `json:"rows,omitempty"`     // for "resize" and "hello" types
+	Session  string  `json:"session,omitempty"`  // for "hello", "session", "open" and "opened" types; never sent to viewers
+	View     string  `json:"view,omitempty"`     // for "hello", "session" and "opened" types, the ID viewers join with; for "open" type, joins read-only
+	Resumed  bool    `json:"resumed,omitempty"`  // for "session" and "opened" types
+	Launcher string  `json:"launcher,omitempty"` // for "open" type; for "hello" and "exit" types, the launcher that ran login
+	Code     *int    `json:"code,omitempty"`     // for "exit" and "closed" types, nil if unknown
+	Reason   string  `json:"reason,omitempty"`   // for "closed" type
+	Role     string  `json:"role,omitempty"`     // for "open" type: "viewer" joins read-only; for "hello" type, set for viewers
+	Remote   string  `json:"remote,omitempty"`   // for "join" and "leave" types
+	Viewers  int     `json:"viewers,omitempty"`  // for "join" and "leave" types: current viewer count
+	Offset   float64 `json:"offset,omitempty"`   // for "seek" type during playback, in seconds
+	Seconds  int     `json:"seconds,omitempty"`  // for "warning" type: seconds until the session is closed
+	Window   int64   `json:"window,omitempty"`   // for "flow" and "open"/"opened" types: flow control window in bytes
+	Bytes    int64   `json:"bytes,omitempty"`    // for "ack" type: output bytes consumed since the last ack; for "progress" and "transferred" types, bytes transferred
+	Message  string  `json:"message,omitempty"`  // for "error" type
+	Signal   string  `json:"signal,omitempty"`   // for "signal" type, e.g. "INT"; for "exit" and "closed" types, the terminating signal
+	Target   string  `json:"target,omitempty"`   // for "signal" type: "foreground" (default) or "session"
+
+	LauncherFailed bool `json:"launcher_failed,omitempty"` // for "exit" and "closed" types: the launcher failed, not login
+
+	// For "hello" type: the server version, the PTY slave device and the
+	// features enabled on the connection (see hello).
+	Version      string   `json:"version,omitempty"`
+	PTY          string   `json:"pty,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Terminal state reported by the shell (see osc.go): "title" and "cwd"
+	// messages, also set in "hello", and "prompt" with the OSC 133 mark
+	// (and for mark "D" the command's exit status in Code).
+	Title string `json:"title,omitempty"`
+	Cwd   string `json:"cwd,omitempty"`
+	Mark  string `json:"mark,omitempty"`
+
+	// For "clipboard" type: OSC 52 held back for the client to confirm.
+	// Action "write" copies Payload to the selection (usually "c"); "read"
+	// asks for the clipboard contents, which the client may send back as
+	// input in an OSC 52 reply.
+	Action    string `json:"action,omitempty"`
+	Selection string `json:"selection,omitempty"`
+
+	// For "upload", "download", "file-data", "cancel", "progress" and
+	// "transferred" types (see transfer.go): the client's ID for the
+	// transfer, the file name, its size and its SHA-256 checksum in hex.
+	// "file-data" carries the file contents in Payload.
+	Transfer string `json:"transfer,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
 }
 
 const (
 	writeWait      = 10 * time.Second
 	pongWait       = 30 * time.Second // 30 seconds for ping/pong
 	pingPeriod     = (pongWait * 9) / 10
-	idleTimeout    = 5 * time.Minute // 5 minutes idle disconnect
-	ptyBufferSize  = 64 * 1024       // 64KB chunks for PTY reads
-	maxMessageSize = 512 * 1024      // 512KB max message size
+	ptyBufferSize  = 64 * 1024  // 64KB chunks for PTY reads
+	maxMessageSize = 512 * 1024 // 512KB max message size
 )
 
+// upgrader holds the common upgrade settings. Handlers copy it and set
+// CheckOrigin from their OriginPolicy.
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  64 * 1024,
 	WriteBufferSize: 64 * 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for simplicity (adjust for production)
-		return true
-	},
+}
+
+// Application close codes (4000-4999 are reserved for private use).
+const (
+	closeSessionReplaced = 4001 // another connection attached to the session
+	closeSessionNotFound = 4004 // reattach requested for an unknown or expired session
+	closeViewerTooSlow   = 4008 // a read-only viewer fell too far behind the session output
+	closeLauncherFailed  = 4011 // the launcher failed before login started, e.g. systemd-run denied by polkit
+)
+
+// roleViewer joins an existing session read-only (?role=viewer). The owner
+// may watch its own session this way; anyone else joins with the session's
+// view ID (?view=<id>), which never grants more than read-only access.
+const roleViewer = "viewer"
+
+// Config holds server-side settings for the WebSocket handler.
+type Config struct {
+	// SessionGrace is how long a session survives without an attached
+	// connection. Zero terminates the login as soon as the connection drops.
+	SessionGrace time.Duration
+	// ScrollbackSize is the number of recent output bytes replayed on reattach.
+	ScrollbackSize int
+	// RecordDir enables asciicast v2 recording of every session into this
+	// directory when non-empty.
+	RecordDir string
+	// FlowWindow caps the flow control window a client may negotiate.
+	// Zero disables flow control.
+	FlowWindow int64
+	// CoalesceDelay bounds how long a burst of PTY output is held back to
+	// merge it into fewer frames. Zero sends every read as its own frame.
+	CoalesceDelay time.Duration
+	// CoalesceBytes sends merged output without waiting once it reaches
+	// this size.
+	CoalesceBytes int
+	// Compression accepts permessage-deflate when the client offers it.
+	Compression bool
+	// CompressionLevel is the flate level (1 fastest to 9 smallest).
+	CompressionLevel int
+	// CompressionMinSize leaves messages smaller than this uncompressed.
+	CompressionMinSize int
+	// TTYDCredential is the "user:password" ttyd clients must authenticate
+	// with. Empty accepts ttyd clients without a token.
+	TTYDCredential string
+	// IdleTimeout closes a session that has had no input or output for
+	// this long. Zero disables the idle timeout.
+	IdleTimeout time.Duration
+	// IdleWarning is how long before an idle or lifetime deadline the
+	// attached clients receive a "warning" message. Zero disables warnings.
+	IdleWarning time.Duration
+	// MaxLifetime closes a session this long after it started, however
+	// busy it is. Zero means no limit.
+	MaxLifetime time.Duration
+	// Origins lists the cross-origin pages allowed to connect. The zero
+	// value allows same-origin pages only.
+	Origins OriginPolicy
+	// CSRF requires browser requests to carry the token issued by
+	// IssueCSRFToken in the csrf query parameter.
+	CSRF bool
+	// Launchers restricts which authenticated identities may use each
+	// launcher strategy. The zero value allows every launcher.
+	Launchers LauncherPolicy
+	// RateLimit is the sustained rate of requests allowed per remote IP by
+	// Handler.RateLimit, in requests per second, with bursts of RateBurst.
+	// Zero disables rate limiting.
+	RateLimit float64
+	RateBurst int
+	// MaxSessions caps the number of concurrent sessions, and
+	// MaxSessionsPerUser the number per authenticated identity. Zero means
+	// no limit.
+	MaxSessions        int
+	MaxSessionsPerUser int
+	// Signals lists the signals clients may send with "signal" messages.
+	// The zero value allows none.
+	Signals SignalPolicy
+	// Version is the server version reported in "hello" messages.
+	Version string
+	// Clipboard decides what happens to OSC 52 clipboard sequences in the
+	// output, and TerminalQueries to queries whose replies can inject
+	// input. The zero values pass the output unchanged; DefaultConfig asks
+	// the client to confirm clipboard access and strips the queries.
+	Clipboard       ClipboardPolicy
+	TerminalQueries QueryPolicy
+	// Recordings decides who besides the recorded user may play recordings.
+	Recordings RecordingPolicy
+	// MaxTransferSize caps the size of a file uploaded or downloaded in
+	// JSON mode. Zero disables file transfer.
+	MaxTransferSize int64
+}
+
+// DefaultConfig returns the handler defaults.
+func DefaultConfig() Config {
+	return Config{
+		SessionGrace:   DefaultSessionGrace,
+		ScrollbackSize: DefaultScrollbackSize,
+		FlowWindow:     DefaultFlowWindow,
+		CoalesceDelay:  DefaultCoalesceDelay,
+		CoalesceBytes:  DefaultCoalesceBytes,
+
+		CompressionLevel:   DefaultCompressionLevel,
+		CompressionMinSize: DefaultCompressionMinSize,
+
+		IdleTimeout: DefaultIdleTimeout,
+		IdleWarning: DefaultIdleWarning,
+
+		RateLimit: DefaultRateLimit,
+		RateBurst: DefaultRateBurst,
+
+		MaxSessions:        DefaultMaxSessions,
+		MaxSessionsPerUser: DefaultMaxSessionsPerUser,
+
+		Signals: mustParseSignalPolicy(DefaultSignals),
+
+		Clipboard:       ClipboardConfirm,
+		TerminalQueries: QueriesStrip,
+
+		MaxTransferSize: DefaultMaxTransferSize,
+	}
 }
 
 // Handler handles WebSocket connections and bridges PTY I/O.
 // Supports both binary transparent mode (default) and JSON message mode.
-func Handler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// Login sessions are kept in a registry so a client can reattach with
+// ?session=<id> after the connection drops.
+type Handler struct {
+	cfg      Config
+	sessions *registry
+	stats    outputStats
+	limiter  *rateLimiter // nil when rate limiting is disabled
+}
+
+// NewHandler creates a Handler with the given configuration.
+func NewHandler(cfg Config) *Handler {
+	return &Handler{
+		cfg:      cfg,
+		sessions: newRegistry(cfg),
+		limiter:  newRateLimiter(cfg.RateLimit, cfg.RateBurst),
+	}
+}
+
+// Close terminates all live sessions.
+func (h *Handler) Close() {
+	h.sessions.closeAll()
+}
+
+// Stats returns the output counters across all connections, and the
+// compression statistics of each live session. Who started a session, from
+// where, what it is doing and its ID, with which it can be joined, are only
+// included for the sessions ident started; anonymous requests see none.
+func (h *Handler) Stats(ident *auth.Identity) Stats {
+	stats := h.stats.snapshot()
+	stats.Sessions = []SessionStats{}
+	for _, s := range h.sessions.list() {
+		ss := s.stats()
+		if ident == nil || ident.Key() != s.userKey {
+			ss = SessionStats{Launcher: ss.Launcher, Started: ss.Started, RawBytes: ss.RawBytes, WireBytes: ss.WireBytes}
+		}
+		stats.Sessions = append(stats.Sessions, ss)
+	}
+	return stats
+}
+
+// ServeHTTP upgrades the request and attaches it to a new or existing session.
+// The wire protocol is negotiated through Sec-WebSocket-Protocol (see
+// protocol.go); requests offering only unknown subprotocols are rejected
+// with 400 Bad Request before the upgrade, and requests over the session
+// caps with 429 Too Many Requests. The rate limit is applied separately,
+// see RateLimit.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.admit(w, r) || !checkRequest(h.cfg, w, r) {
+		return
+	}
+	proto, err := selectProtocol(r)
+	if err != nil {
+		slog.Info("rejected WebSocket request", "remote", r.RemoteAddr, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := h.upgrade(w, r, proto)
 	if err != nil {
 		slog.Error("failed to upgrade WebSocket", "error", err)
 		return
@@ -58,43 +281,12 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	slog.Info("WebSocket connection established", "remote", r.RemoteAddr)
+	slog.Info("WebSocket connection established", "remote", r.RemoteAddr, "user", userName(auth.FromContext(r.Context())),
+		"protocol", proto, "compressed", conn.compressed)
 
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	// Determine login launcher strategy from query parameter
-	strategy := systemd.StrategyAuto
-	if strategyParam := r.URL.Query().Get("launcher"); strategyParam != "" {
-		strategy = systemd.LoginStrategy(strategyParam)
-	}
-
-	// Start login shell with selected launcher strategy
-	cmd, ptyMaster, cleanup, err := systemd.RunLoginPTY(ctx, strategy)
-	if err != nil {
-		slog.Error("failed to start login PTY", "error", err, "strategy", strategy)
-		sendCloseMessage(conn, websocket.CloseInternalServerErr, fmt.Sprintf("Failed to start login: %v", err))
-		return
-	}
-	defer func() {
-		if cmd.Process != nil {
-			slog.Debug("killing process", "pid", cmd.Process.Pid)
-			if err := cmd.Process.Kill(); err != nil {
-				slog.Warn("failed to kill process", "error", err)
-			}
-		}
-		if err := cleanup(); err != nil {
-			slog.Warn("failed to cleanup", "error", err)
-		}
-		if err := cmd.Wait(); err != nil {
-			slog.Warn("failed to wait for process", "error", err)
-		}
-	}()
-
-	// Determine mode: check query parameter ?mode=json for JSON mode
-	mode := r.URL.Query().Get("mode")
-	useBinaryMode := mode != "json"
-
 	// Setup ping/pong with idle timeout
 	if err := conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
 		slog.Warn("failed to set read deadline", "error", err)
@@ -105,6 +297,73 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		}
 		return nil
 	})
+	go keepAlive(ctx, cancel, conn)
+
+	switch proto {
+	case protocolMux:
+		h.serveMux(ctx, conn, r)
+	case protocolTTYD:
+		h.serveTTYD(ctx, cancel, conn, r)
+	case protocolK8s:
+		h.serveK8s(ctx, cancel, conn, r)
+	default:
+		h.serveSession(ctx, cancel, conn, r, proto)
+	}
+	slog.Info("WebSocket connection closed", "remote", r.RemoteAddr)
+}
+
+// serveSession bridges a connection to a single login session using the
+// binary, JSON or legacy protocol.
+func (h *Handler) serveSession(ctx context.Context, cancel context.CancelFunc, conn *wsConn, r *http.Request, proto string) {
+	useBinaryMode := proto != protocolJSON
+	query := r.URL.Query()
+	sess, sub, scrollback, resumed, ok := h.attachRequest(conn, r, proto)
+	if !ok {
+		return
+	}
+	defer sess.detach(sub)
+
+	// Flow control is opt-in per connection with ?flow=<window bytes>
+	flow := flowFromRequest(r, h.cfg.FlowWindow)
+
+	// Describe the session first, then tell the client which session it is
+	// attached to so it can reattach later. Legacy binary clients, which
+	// negotiated no subprotocol, expect nothing but terminal output.
+	if proto != protocolLegacy {
+		hello := h.hello(conn, sess, sub, flow)
+		// Transfers run as the user found on the PTY, which systemd-run never is
+		if !useBinaryMode && !sub.viewer && h.cfg.MaxTransferSize > 0 && systemd.LoginOnPTY(sess.login) {
+			hello.Capabilities = append(hello.Capabilities, capTransfer)
+		}
+		if err := conn.writeJSON(hello); err != nil {
+			slog.Warn("failed to send hello message", "error", err)
+			return
+		}
+		msg := Message{Type: "session", Resumed: resumed}
+		msg.Session, msg.View = sessionIDs(sess, sub)
+		if err := conn.writeJSON(msg); err != nil {
+			slog.Warn("failed to send session message", "error", err)
+			return
+		}
+	}
+	if query.Has("flow") {
+		if err := conn.writeJSON(Message{Type: "flow", Window: flow.size()}); err != nil {
+			slog.Warn("failed to send flow message", "error", err)
+			return
+		}
+	}
+
+	sink := sessionSink{conn: conn, useBinaryMode: useBinaryMode, events: proto != protocolLegacy, stats: &sess.output}
+	filter := newOutputFilter(h.cfg)
+	if len(scrollback) > 0 && (resumed || sub.viewer) {
+		// Clipboard requests in the scrollback are not asked again
+		scrollback, _ = filter.filter(scrollback)
+		if err := sink.sendData(scrollback); err != nil {
+			slog.Warn("failed to replay scrollback", "error", err)
+			return
+		}
+		flow.sent(len(scrollback))
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -113,102 +372,323 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		defer wg.Done()
 		defer cancel()
-		if err := ptyToWebSocket(conn, ptyMaster, useBinaryMode); err != nil {
-			if err != io.EOF {
-				slog.Error("PTY to WebSocket error", "error", err)
-			} else {
-				slog.Info("PTY closed (EOF)")
+		err := ptyToWebSocket(ctx, sub, sink, flow, filter, newCoalescer(h.cfg, &h.stats))
+		// Sent as a text frame in binary mode too, like the session message
+		if err == io.EOF && proto != protocolLegacy {
+			if err := conn.writeJSON(sess.exitInfo().message()); err != nil {
+				slog.Warn("failed to send exit message", "error", err)
 			}
 		}
-		// PTY EOF - close WebSocket normally
-		sendCloseMessage(conn, websocket.CloseNormalClosure, "PTY closed")
+		closeAfterOutput(conn, sess, err)
 	}()
 
 	// Goroutine 2: Read from WebSocket, write to PTY
+	files := newTransfers(conn, sess, sub, flow, h.cfg.MaxTransferSize)
+	defer files.close()
 	go func() {
 		defer wg.Done()
 		defer cancel()
-		if err := webSocketToPTY(conn, ptyMaster, useBinaryMode); err != nil {
+		if err := webSocketToPTY(conn, sess, sub, flow, proto, h.cfg.Signals, files); err != nil {
 			slog.Error("WebSocket to PTY error", "error", err)
 		}
-		// WebSocket closed/error - kill PTY process
-		if cmd.Process != nil {
-			if err := cmd.Process.Kill(); err != nil {
-				slog.Warn("failed to kill process", "error", err)
-			}
-		}
+		// WebSocket closed/error - the session is detached and kept for the grace period
 	}()
 
-	// Goroutine 3: Send periodic pings and check idle timeout
-	go func() {
-		ticker := time.NewTicker(pingPeriod)
-		defer ticker.Stop()
-		idleTimer := time.NewTimer(idleTimeout)
-		defer idleTimer.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				if err := conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-					slog.Warn("failed to set write deadline for ping", "error", err)
-				}
-				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-					slog.Warn("ping failed", "error", err)
-					cancel()
-					return
-				}
-			case <-idleTimer.C:
-				slog.Info("idle timeout reached", "timeout", idleTimeout)
-				sendCloseMessage(conn, websocket.CloseNormalClosure, "idle timeout")
+	wg.Wait()
+}
+
+// keepAlive sends periodic pings until ctx is done. Idle sessions are
+// closed by the session itself (see watchTimeouts).
+func keepAlive(ctx context.Context, cancel context.CancelFunc, conn *wsConn) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.writeMessage(websocket.PingMessage, nil); err != nil {
+				slog.Warn("ping failed", "error", err)
 				cancel()
 				return
-			case <-ctx.Done():
-				return
 			}
+		case <-ctx.Done():
+			return
 		}
-	}()
+	}
+}
 
-	wg.Wait()
-	slog.Info("WebSocket connection closed", "remote", r.RemoteAddr)
+// openSession returns the session with the given ID or view ID, or starts
+// a new login session for the request when both are empty. resumed reports
+// whether an existing session was found. New sessions are subject to the
+// constraints of the authenticated identity, if any, and existing ones may
+// only be joined by the identity that started them. A view ID may be
+// shared with anyone, since callers only ever attach to its session as a
+// viewer.
+func (h *Handler) openSession(id, view, launcher string, r *http.Request) (sess *session, resumed bool, err error) {
+	ident := auth.FromContext(r.Context())
+	if view != "" {
+		sess, err := h.sessions.getView(view)
+		if err != nil {
+			return nil, false, err
+		}
+		return sess, true, nil
+	}
+	if id != "" {
+		sess, err := h.sessions.get(id)
+		if err != nil {
+			return nil, false, err
+		}
+		// Another identity's session is reported as unknown, not revealed
+		if sess.userKey != userKey(ident) {
+			return nil, false, fmt.Errorf("%w: started by %q, requested by %q", errSessionNotFound, sess.userKey, userKey(ident))
+		}
+		if !h.cfg.Launchers.permits(sess.launcher, ident) || (ident != nil && ident.Launcher != "" && ident.Launcher != sess.launcher) {
+			return nil, false, fmt.Errorf("%w: %s for %q", errLauncherNotAllowed, sess.launcher, userName(ident))
+		}
+		return sess, true, nil
+	}
+
+	if ident != nil && ident.Launcher != "" {
+		if launcher != "" && launcher != ident.Launcher {
+			return nil, false, fmt.Errorf("%w: %s for %s", errLauncherNotAllowed, launcher, ident.Name)
+		}
+		launcher = ident.Launcher
+	}
+
+	// Determine login launcher strategy from query parameter
+	strategy := systemd.StrategyAuto
+	if launcher != "" {
+		strategy = systemd.LoginStrategy(launcher)
+	}
+
+	// Start login shell with selected launcher strategy
+	sess, err = h.sessions.start(strategy, r.RemoteAddr, ident)
+	if err != nil {
+		return nil, false, fmt.Errorf("strategy %s: %w", strategy, err)
+	}
+	return sess, false, nil
 }
 
-// ptyToWebSocket reads from PTY and sends to WebSocket.
-// In binary mode: sends raw binary frames.
-// In JSON mode: sends {"type":"data","payload":"base64..."} messages.
-func ptyToWebSocket(conn *websocket.Conn, ptyMaster *os.File, useBinaryMode bool) error {
-	buf := make([]byte, ptyBufferSize)
+// outputSink frames session output and notifications for a connection's protocol.
+type outputSink interface {
+	sendData(data []byte) error
+	sendEvent(msg Message) error
+}
+
+// attachRequest opens the session named by the request's query parameters
+// (session, view, launcher, role) and attaches to it for a connection
+// using proto. On failure the connection is closed with a matching code
+// and ok is false; JSON clients are also sent an error message when the
+// login fails to start.
+func (h *Handler) attachRequest(conn *wsConn, r *http.Request, proto string) (sess *session, sub *subscriber, scrollback []byte, resumed, ok bool) {
+	query := r.URL.Query()
+	viewer := query.Get("role") == roleViewer || query.Has("view")
+	if viewer && query.Get("session") == "" && query.Get("view") == "" {
+		sendCloseMessage(conn, websocket.ClosePolicyViolation, "viewers must specify a session")
+		return nil, nil, nil, false, false
+	}
+	sess, resumed, err := h.openSession(query.Get("session"), query.Get("view"), query.Get("launcher"), r)
+	if err != nil {
+		if errors.Is(err, errSessionNotFound) || errors.Is(err, errSessionExited) {
+			slog.Info("reattach rejected", "remote", r.RemoteAddr, "error", err)
+			sendCloseMessage(conn, closeSessionNotFound, "unknown session")
+			return nil, nil, nil, false, false
+		}
+		if errors.Is(err, errLauncherNotAllowed) {
+			slog.Info("launcher rejected", "remote", r.RemoteAddr, "error", err)
+			sendCloseMessage(conn, websocket.ClosePolicyViolation, "launcher not allowed")
+			return nil, nil, nil, false, false
+		}
+		if errors.Is(err, errTooManySessions) {
+			slog.Info("session refused", "remote", r.RemoteAddr, "error", err)
+			sendCloseMessage(conn, closeTryAgainLater, errTooManySessions.Error())
+			return nil, nil, nil, false, false
+		}
+		slog.Error("failed to start login PTY", "error", err)
+		if proto == protocolJSON {
+			sendError(conn, fmt.Sprintf("failed to start login: %v", err))
+		}
+		sendCloseMessage(conn, websocket.CloseInternalServerErr, fmt.Sprintf("Failed to start login: %v", err))
+		return nil, nil, nil, false, false
+	}
+	sub, scrollback, err = attachAs(sess, viewer, r.RemoteAddr)
+	if err != nil {
+		slog.Info("reattach rejected", "remote", r.RemoteAddr, "session", sess.id, "error", err)
+		sendCloseMessage(conn, closeSessionNotFound, "unknown session")
+		return nil, nil, nil, false, false
+	}
+	slog.Info("session attached", "session", sess.id, "remote", r.RemoteAddr, "resumed", resumed, "viewer", sub.viewer)
+	return sess, sub, scrollback, resumed, true
+}
+
+// closeAfterOutput closes the connection once ptyToWebSocket has returned
+// err, with a close code telling the client why.
+func closeAfterOutput(conn *wsConn, sess *session, err error) {
+	switch {
+	case err == io.EOF:
+		slog.Info("PTY closed (EOF)", "session", sess.id)
+		sendCloseMessage(conn, endCode(sess), endMessage(sess))
+	case errors.Is(err, errSessionReplaced):
+		slog.Info("session attached elsewhere", "session", sess.id)
+		sendCloseMessage(conn, closeSessionReplaced, "session attached elsewhere")
+	case errors.Is(err, errViewerTooSlow):
+		sendCloseMessage(conn, closeViewerTooSlow, "viewer too slow")
+	case err != nil:
+		slog.Error("PTY to WebSocket error", "error", err)
+	}
+}
+
+// endMessage is the close reason sent when the session's PTY closes: why
+// the server closed it, or how the login process ended.
+func endMessage(sess *session) string {
+	if reason := sess.closedBy(); reason != nil {
+		return reason.Error()
+	}
+	return sess.exitInfo().reason()
+}
+
+// endCode is the close code sent when the session's PTY closes.
+func endCode(sess *session) int {
+	if sess.closedBy() != nil {
+		return websocket.CloseNormalClosure
+	}
+	return sess.exitInfo().closeCode()
+}
+
+// attachAs attaches to sess as its owner, or as a read-only viewer.
+func attachAs(sess *session, viewer bool, remote string) (*subscriber, []byte, error) {
+	if viewer {
+		return sess.attachViewer(remote)
+	}
+	return sess.attach(remote)
+}
+
+// ptyToWebSocket forwards session output and events to the WebSocket
+// through sink, merging bursts of reads with batch and removing the
+// sequences filter does not allow (nil passes everything). While flow is
+// paused, output is left queued in the session, which in turn stops reading
+// the PTY. Returns io.EOF when the PTY closes, or the reason the subscriber
+// was dropped (e.g. errSessionReplaced).
+func ptyToWebSocket(ctx context.Context, sub *subscriber, sink outputSink, flow *flowControl, filter *outputFilter, batch *coalescer) error {
+	// Fires when the filter has held the start of a sequence for too long
+	var expire <-chan time.Time
 	for {
-		n, err := ptyMaster.Read(buf)
-		if n > 0 {
-			if err := conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				slog.Warn("failed to set write deadline", "error", err)
+		resumed := flow.resumed()
+		out := sub.out
+		if flow.paused() {
+			out = nil
+		}
+		select {
+		case data, ok := <-out:
+			if !ok {
+				return io.EOF
 			}
-			if useBinaryMode {
-				// Binary transparent mode: send raw bytes
-				if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-					return fmt.Errorf("failed to send binary message: %w", err)
+			data, eof := batch.gather(ctx, sub, data, flow.available())
+			data, events := filter.filter(data)
+			if !filter.pending() {
+				expire = nil
+			} else if expire == nil {
+				expire = time.After(heldSequenceTimeout)
+			}
+			if len(data) > 0 {
+				if err := sink.sendData(data); err != nil {
+					return err
 				}
-			} else {
-				// JSON mode: not implemented for output in this version
-				// For simplicity, always use binary for PTY output
-				if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-					return fmt.Errorf("failed to send binary message: %w", err)
+				flow.sent(len(data))
+			}
+			for _, msg := range events {
+				if err := sink.sendEvent(msg); err != nil {
+					return err
 				}
 			}
-		}
-		if err != nil {
-			if err == io.EOF {
+			if eof {
 				return io.EOF
 			}
-			return fmt.Errorf("PTY read error: %w", err)
+		case <-resumed:
+			// Credit returned; re-check the window
+		case <-expire:
+			expire = nil
+			if len(sub.out) > 0 {
+				// The rest may be queued, e.g. while flow is paused
+				expire = time.After(heldSequenceTimeout)
+				continue
+			}
+			filter.expire()
+		case msg := <-sub.events:
+			if err := sink.sendEvent(msg); err != nil {
+				return err
+			}
+		case <-sub.closed:
+			return sub.err
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
 
+// sessionSink writes output for a single-session connection.
+type sessionSink struct {
+	conn          *wsConn
+	useBinaryMode bool
+	events        bool // false for legacy clients, which expect output only
+	stats         *compressionStats
+}
+
+func (s sessionSink) sendData(data []byte) error {
+	return sendOutput(s.conn, data, s.useBinaryMode, s.stats)
+}
+
+// sendEvent writes notifications as JSON text frames in both modes, and
+// drops them for legacy clients.
+func (s sessionSink) sendEvent(msg Message) error {
+	if !s.events {
+		return nil
+	}
+	return s.conn.writeJSON(msg)
+}
+
+// sendOutput writes PTY output to the WebSocket in the connection's mode.
+// In binary mode: sends raw binary frames.
+// In JSON mode: sends {"type":"data","payload":"base64..."} messages.
+// The message sizes before and after compression are added to stats.
+func sendOutput(conn *wsConn, data []byte, useBinaryMode bool, stats *compressionStats) error {
+	if useBinaryMode {
+		// Binary transparent mode: send raw bytes
+		if err := conn.writeData(websocket.BinaryMessage, data, stats); err != nil {
+			return fmt.Errorf("failed to send binary message: %w", err)
+		}
+		return nil
+	}
+	// JSON mode: wrap output in a data message
+	msg, err := json.Marshal(Message{Type: "data", Payload: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode data message: %w", err)
+	}
+	if err := conn.writeData(websocket.TextMessage, msg, stats); err != nil {
+		return fmt.Errorf("failed to send data message: %w", err)
+	}
+	return nil
+}
+
+// sendError reports a recoverable protocol error to a JSON mode client.
+func sendError(conn *wsConn, message string) {
+	if err := conn.writeJSON(Message{Type: "error", Message: message}); err != nil {
+		slog.Warn("failed to send error message", "error", err)
+	}
+}
+
 // webSocketToPTY reads from WebSocket and writes to PTY.
-// In binary mode: expects raw binary frames or JSON resize messages.
+// In binary mode: expects raw binary frames or JSON resize messages. Text
+// frames that are not control messages are rejected with protocolBinary and
+// written to the PTY as input with protocolLegacy.
 // In JSON mode: expects {"type":"data","payload":"..."} or {"type":"resize",...}
-func webSocketToPTY(conn *websocket.Conn, ptyMaster *os.File, useBinaryMode bool) error {
+// Both modes accept {"type":"ack","bytes":N} when flow control is enabled,
+// and {"type":"signal","signal":"INT"} for the signals allowed by signals.
+// JSON mode also accepts the file transfer messages handled by files.
+// Input, resize, signal and transfer requests from read-only viewers are
+// rejected.
+func webSocketToPTY(conn *wsConn, sess *session, sub *subscriber, flow *flowControl, proto string, signals SignalPolicy, files *transfers) error {
+	useBinaryMode := proto != protocolJSON
 	conn.SetReadLimit(maxMessageSize)
 	for {
 		messageType, data, err := conn.ReadMessage()
@@ -228,24 +708,28 @@ func webSocketToPTY(conn *websocket.Conn, ptyMaster *os.File, useBinaryMode bool
 			switch messageType {
 			case websocket.BinaryMessage:
 				// Write raw binary data to PTY
-				if _, err := ptyMaster.Write(data); err != nil {
-					return fmt.Errorf("PTY write error: %w", err)
+				if err := writeInput(conn, sess, sub, data, useBinaryMode); err != nil {
+					return err
 				}
 			case websocket.TextMessage:
-				// Check if it's a resize message
+				// Check if it's a resize, ack or signal message. Legacy
+				// clients predate signals and only ack when they asked
+				// for flow control; anything else they send is input.
 				var msg Message
 				if err := json.Unmarshal(data, &msg); err == nil && msg.Type == "resize" {
-					if msg.Cols > 0 && msg.Rows > 0 {
-						if err := pty.SetWinsize(ptyMaster.Fd(), msg.Cols, msg.Rows); err != nil {
-							slog.Warn("failed to resize PTY", "error", err)
-						} else {
-							slog.Debug("PTY resized", "cols", msg.Cols, "rows", msg.Rows)
-						}
+					resizePTY(conn, sess, sub, msg, useBinaryMode)
+				} else if err == nil && msg.Type == "ack" && (proto != protocolLegacy || flow != nil) {
+					flow.ack(msg.Bytes)
+				} else if err == nil && msg.Type == "signal" && proto != protocolLegacy {
+					if err := handleSignal(sess, sub, msg, signals); err != nil {
+						sendError(conn, err.Error())
 					}
+				} else if proto == protocolBinary {
+					sendError(conn, "text frames must be JSON control messages")
 				} else {
 					// Treat as raw text and write to PTY
-					if _, err := ptyMaster.Write(data); err != nil {
-						return fmt.Errorf("PTY write error: %w", err)
+					if err := writeInput(conn, sess, sub, data, useBinaryMode); err != nil {
+						return err
 					}
 				}
 			}
@@ -254,32 +738,121 @@ func webSocketToPTY(conn *websocket.Conn, ptyMaster *os.File, useBinaryMode bool
 			var msg Message
 			if err := json.Unmarshal(data, &msg); err != nil {
 				slog.Warn("failed to parse JSON message", "error", err)
+				sendError(conn, "invalid JSON message")
 				continue
 			}
 
 			switch msg.Type {
+			case "data":
+				if err := writeInput(conn, sess, sub, msg.Payload, useBinaryMode); err != nil {
+					return err
+				}
 			case "resize":
-				if msg.Cols > 0 && msg.Rows > 0 {
-					if err := pty.SetWinsize(ptyMaster.Fd(), msg.Cols, msg.Rows); err != nil {
-						slog.Warn("failed to resize PTY", "error", err)
-					} else {
-						slog.Debug("PTY resized", "cols", msg.Cols, "rows", msg.Rows)
-					}
+				resizePTY(conn, sess, sub, msg, useBinaryMode)
+			case "ack":
+				flow.ack(msg.Bytes)
+			case "signal":
+				if err := handleSignal(sess, sub, msg, signals); err != nil {
+					sendError(conn, err.Error())
+				}
+			case "upload", "file-data", "download", "cancel":
+				if err := files.handle(msg); err != nil {
+					files.send(Message{Type: "error", Transfer: msg.Transfer, Message: err.Error()})
 				}
 			default:
 				slog.Warn("unknown message type in JSON mode", "type", msg.Type)
+				sendError(conn, fmt.Sprintf("unknown message type %q", msg.Type))
 			}
 		}
 	}
 }
 
-// sendCloseMessage sends a close message to the WebSocket client.
-func sendCloseMessage(conn *websocket.Conn, closeCode int, message string) {
-	if err := conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-		slog.Warn("failed to set write deadline for close message", "error", err)
+// writeInput forwards client input to the PTY if sub owns the session.
+func writeInput(conn *wsConn, sess *session, sub *subscriber, data []byte, useBinaryMode bool) error {
+	if !sess.isOwner(sub) {
+		if !useBinaryMode {
+			sendError(conn, "input ignored: "+errReadOnly.Error())
+		}
+		return nil
 	}
+	return sess.write(data)
+}
+
+// resizePTY applies a resize request; only the owner has resize authority.
+func resizePTY(conn *wsConn, sess *session, sub *subscriber, msg Message, useBinaryMode bool) {
+	if !sess.isOwner(sub) {
+		if !useBinaryMode {
+			sendError(conn, "resize ignored: "+errReadOnly.Error())
+		}
+		return
+	}
+	if msg.Cols <= 0 || msg.Rows <= 0 {
+		if !useBinaryMode {
+			sendError(conn, "resize requires positive cols and rows")
+		}
+		return
+	}
+	if err := sess.resize(msg.Cols, msg.Rows); err != nil {
+		slog.Warn("failed to resize PTY", "error", err)
+		if !useBinaryMode {
+			sendError(conn, "failed to resize PTY")
+		}
+		return
+	}
+	slog.Debug("PTY resized", "cols", msg.Cols, "rows", msg.Rows)
+}
+
+// wsConn serializes writes to a WebSocket connection, since gorilla/websocket
+// supports only one concurrent writer.
+//
+// On a connection that negotiated permessage-deflate, only data messages of
+// at least compressMin bytes are compressed.
+type wsConn struct {
+	*websocket.Conn
+	writeMu     sync.Mutex
+	wire        *countingConn // nil when network bytes are not counted
+	compressed  bool
+	compressMin int
+}
+
+// writeMessage writes a single message with the standard write deadline.
+func (c *wsConn) writeMessage(messageType int, data []byte) error {
+	return c.writeData(messageType, data, nil)
+}
+
+// writeData writes a single message and adds its size before and after
+// compression to stats.
+func (c *wsConn) writeData(messageType int, data []byte, stats *compressionStats) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		slog.Warn("failed to set write deadline", "error", err)
+	}
+	if c.compressed {
+		c.EnableWriteCompression(len(data) >= c.compressMin)
+	}
+	if c.wire == nil || stats == nil {
+		return c.WriteMessage(messageType, data)
+	}
+	before := c.wire.written.Load()
+	err := c.WriteMessage(messageType, data)
+	stats.record(len(data), int(c.wire.written.Load()-before))
+	return err
+}
+
+// writeJSON encodes v and writes it as a text message.
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON message: %w", err)
+	}
+	return c.writeMessage(websocket.TextMessage, data)
+}
+
+// sendCloseMessage sends a close message to the WebSocket client.
+func sendCloseMessage(conn *wsConn, closeCode int, message string) {
 	closeMsg := websocket.FormatCloseMessage(closeCode, message)
-	if err := conn.WriteMessage(websocket.CloseMessage, closeMsg); err != nil {
+	if err := conn.writeMessage(websocket.CloseMessage, closeMsg); err != nil {
 		slog.Warn("failed to send close message", "error", err)
 	}
 }
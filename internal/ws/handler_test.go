@@ -4,7 +4,29 @@
 package ws
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	creackpty "github.com/creack/pty"
+	"github.com/danmaid/wsconsole/internal/auth"
+	"github.com/danmaid/wsconsole/internal/recording"
+	"github.com/danmaid/wsconsole/internal/systemd"
+	"github.com/gorilla/websocket"
 )
 
 // Placeholder test to satisfy go test
@@ -13,3 +35,1668 @@ func TestPlaceholder(t *testing.T) {
 	// TODO: Add proper WebSocket handler tests
 	t.Log("WebSocket handler tests not yet implemented")
 }
+
+// catLauncher runs /bin/cat on the PTY in place of /bin/login.
+type catLauncher struct{}
+
+func (catLauncher) Name() string { return "cat" }
+
+func (catLauncher) Launch(ctx context.Context, slave *os.File) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, "cat")
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	return cmd, nil
+}
+
+func selectCat(systemd.LoginStrategy) (systemd.LoginLauncher, error) {
+	return catLauncher{}, nil
+}
+
+// newTestServer serves a Handler whose sessions run /bin/cat.
+func newTestServer(t *testing.T, cfg Config) (*Handler, *httptest.Server) {
+	t.Helper()
+	h := NewHandler(cfg)
+	h.sessions.selectLauncher = selectCat
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() {
+		srv.Close()
+		h.Close()
+	})
+	return h, srv
+}
+
+// dial opens a WebSocket to the test server with the given query string.
+func dial(t *testing.T, srv *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	if query != "" {
+		url += "?" + query
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readJSON reads messages until one of the given type arrives.
+func readJSON(t *testing.T, conn *websocket.Conn, msgType string) Message {
+	t.Helper()
+	for {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %q message: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestJSONModeRoundTrip(t *testing.T) {
+	_, srv := newTestServer(t, DefaultConfig())
+	conn := dial(t, srv, "mode=json")
+
+	if msg := readJSON(t, conn, "session"); msg.Session == "" {
+		t.Fatal("session message has no ID")
+	}
+	if err := conn.WriteJSON(Message{Type: "data", Payload: []byte("hello\n")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out []byte
+	for !bytes.Contains(out, []byte("hello")) {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read output: %v (got %q)", err, out)
+		}
+		if messageType != websocket.TextMessage {
+			t.Fatalf("got message type %d in JSON mode", messageType)
+		}
+		msg := readMessage(t, data)
+		if msg.Type == "data" {
+			out = append(out, msg.Payload...)
+		}
+	}
+}
+
+func TestHelloMessage(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Version = "1.2.3"
+	_, srv := newTestServer(t, cfg)
+	owner := dial(t, srv, "mode=json&flow=65536")
+
+	// hello comes before anything else
+	var hello Message
+	if err := owner.ReadJSON(&hello); err != nil || hello.Type != "hello" {
+		t.Fatalf("first message = %+v, %v; want hello", hello, err)
+	}
+	if hello.Session != readJSON(t, owner, "session").Session || hello.Version != "1.2.3" || hello.Launcher != "cat" ||
+		!strings.HasPrefix(hello.PTY, "/dev/pts/") || hello.Role != "" {
+		t.Fatalf("hello = %+v", hello)
+	}
+	if got := strings.Join(hello.Capabilities, ","); got != "resume,flow,signal,transfer" {
+		t.Errorf("capabilities = %q", got)
+	}
+
+	// Viewers see the current size and cannot send signals
+	if err := owner.WriteJSON(Message{Type: "resize", Cols: 100, Rows: 30}); err != nil {
+		t.Fatal(err)
+	}
+	// Once input sent after the resize echoes, the resize has been applied
+	if err := owner.WriteJSON(Message{Type: "data", Payload: []byte("x\n")}); err != nil {
+		t.Fatal(err)
+	}
+	readJSON(t, owner, "data")
+	viewer := dial(t, srv, "mode=json&role=viewer&session="+hello.Session)
+	readJSON(t, owner, "join")
+	hello = readJSON(t, viewer, "hello")
+	if hello.Cols != 100 || hello.Rows != 30 || hello.Role != roleViewer || strings.Join(hello.Capabilities, ",") != "resume" {
+		t.Fatalf("viewer hello = %+v", hello)
+	}
+
+	// No signals or file transfer where the user's session is not on the PTY
+	h, srv := newTestServer(t, cfg)
+	h.sessions.selectLauncher = func(systemd.LoginStrategy) (systemd.LoginLauncher, error) {
+		return forwardingLauncher{}, nil
+	}
+	hello = readJSON(t, dial(t, srv, "mode=json"), "hello")
+	if got := strings.Join(hello.Capabilities, ","); got != "resume" {
+		t.Errorf("forwarding launcher capabilities = %q", got)
+	}
+
+	// Clients without a subprotocol receive nothing but output, not even
+	// the title it sets
+	legacy := dial(t, srv, "")
+	for _, input := range []string{"\x1b]2;title\x07\n", "done\n"} {
+		if err := legacy.WriteMessage(websocket.BinaryMessage, []byte(input)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The echo of both lines and cat's copies may interleave; the second
+	// "done" is cat's, written after the title
+	for out := []byte{}; bytes.Count(out, []byte("done")) < 2; {
+		messageType, data, err := legacy.ReadMessage()
+		if err != nil || messageType != websocket.BinaryMessage {
+			t.Fatalf("legacy message = %d %q, %v; want output", messageType, data, err)
+		}
+		out = append(out, data...)
+	}
+}
+
+// forwardingLauncher stands in for systemd-run, which runs login on a PTY
+// of its own.
+type forwardingLauncher struct{ catLauncher }
+
+func (forwardingLauncher) ForwardsPTY() bool { return true }
+
+func TestTerminalEvents(t *testing.T) {
+	h, srv := newTestServer(t, DefaultConfig())
+	conn := dial(t, srv, "mode=json")
+	id := readJSON(t, conn, "session").Session
+
+	// cat writes the sequences back as the shell would
+	osc := "\x1b]2;vim notes.txt\x07\x1b]7;file://host/tmp\x07\x1b]133;C\x07\n"
+	if err := conn.WriteJSON(Message{Type: "data", Payload: []byte(osc)}); err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	var events []Message
+	for len(events) < 3 || !bytes.Contains(out, []byte("\x1b]133;C\x07")) {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("read: %v (events %+v)", err, events)
+		}
+		switch msg.Type {
+		case "data":
+			out = append(out, msg.Payload...)
+		case "title", "cwd", "prompt":
+			events = append(events, msg)
+		}
+	}
+	if events[0].Title != "vim notes.txt" || events[1].Cwd != "/tmp" || events[2].Mark != "C" {
+		t.Fatalf("events = %+v", events)
+	}
+	// The output is passed through unchanged
+	if !bytes.Contains(out, []byte("\x1b]2;vim notes.txt\x07\x1b]7;file://host/tmp\x07")) {
+		t.Errorf("output %q lacks the sequences", out)
+	}
+
+	if s := h.sessions.list(); len(s) != 1 || s[0].stats().Title != "vim notes.txt" || s[0].stats().Cwd != "/tmp" || s[0].stats().Activity != activityRunning {
+		t.Errorf("stats = %+v", s[0].stats())
+	}
+	viewer := dial(t, srv, "mode=json&role=viewer&session="+id)
+	if hello := readJSON(t, viewer, "hello"); hello.Title != "vim notes.txt" || hello.Cwd != "/tmp" {
+		t.Errorf("hello = %+v", hello)
+	}
+}
+
+func TestClipboardConfirm(t *testing.T) {
+	_, srv := newTestServer(t, DefaultConfig())
+	conn := dial(t, srv, "mode=json")
+	readJSON(t, conn, "session")
+
+	// A file being cat-ed tries to set the clipboard
+	if err := conn.WriteJSON(Message{Type: "data", Payload: []byte("\x1b]52;c;cm0gLXJmIH4K\x07done\n")}); err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	var clip *Message
+	for clip == nil || !bytes.Contains(out, []byte("done\r\ndone")) {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("read: %v (output %q)", err, out)
+		}
+		switch msg.Type {
+		case "data":
+			out = append(out, msg.Payload...)
+		case "clipboard":
+			clip = &msg
+		}
+	}
+	if clip.Action != "write" || string(clip.Payload) != "rm -rf ~\n" {
+		t.Errorf("clipboard = %+v", clip)
+	}
+	if bytes.Contains(out, []byte("\x1b]52")) {
+		t.Errorf("output %q still contains OSC 52", out)
+	}
+}
+
+func TestJSONModeUnknownType(t *testing.T) {
+	_, srv := newTestServer(t, DefaultConfig())
+	conn := dial(t, srv, "mode=json")
+
+	if err := conn.WriteJSON(Message{Type: "bogus"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, conn, "error"); !strings.Contains(msg.Message, "bogus") {
+		t.Fatalf("error message = %q", msg.Message)
+	}
+}
+
+func TestJSONModeExit(t *testing.T) {
+	_, srv := newTestServer(t, DefaultConfig())
+	conn := dial(t, srv, "mode=json")
+
+	// ^D on an empty line ends cat with status 0
+	if err := conn.WriteJSON(Message{Type: "data", Payload: []byte{0x04}}); err != nil {
+		t.Fatal(err)
+	}
+	msg := readJSON(t, conn, "exit")
+	if msg.Code == nil || *msg.Code != 0 {
+		t.Fatalf("exit code = %v, want 0", msg.Code)
+	}
+}
+
+// userLauncher runs /bin/cat as nobody in a session of its own, in dir,
+// like a shell started by login.
+type userLauncher struct{ dir string }
+
+func (userLauncher) Name() string { return "user" }
+
+func (l userLauncher) Launch(ctx context.Context, slave *os.File) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, "setsid", "-c", "-w", "setpriv", "--reuid=65534", "--regid=65534", "--clear-groups", "cat")
+	cmd.Dir = l.dir
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	return cmd, nil
+}
+
+func TestFileTransfer(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("switching to the session user requires root")
+	}
+	if _, err := exec.LookPath("setpriv"); err != nil {
+		t.Skip("setpriv not available")
+	}
+	dir, err := os.MkdirTemp("", "wsconsole-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chown(dir, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.MaxTransferSize = 1 << 20
+	h, srv := newTestServer(t, cfg)
+	h.sessions.selectLauncher = func(systemd.LoginStrategy) (systemd.LoginLauncher, error) {
+		return userLauncher{dir: dir}, nil
+	}
+	conn := dial(t, srv, "mode=json&flow=4096")
+	readJSON(t, conn, "session")
+	// Wait for the shell stand-in to run as nobody: the terminal echoes the
+	// input at once, cat only once it has started
+	if err := conn.WriteJSON(Message{Type: "data", Payload: []byte("x\n")}); err != nil {
+		t.Fatal(err)
+	}
+	for out := []byte{}; bytes.Count(out, []byte("x")) < 2; {
+		out = append(out, readJSON(t, conn, "data").Payload...)
+	}
+
+	// Upload in two chunks; the file belongs to the session user
+	content := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+	sum := sha256.Sum256(content)
+	send := func(msg Message) {
+		t.Helper()
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(Message{Type: "upload", Transfer: "up", Name: "upload.txt", Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])})
+	if msg := readJSON(t, conn, "progress"); msg.Transfer != "up" || msg.Size != int64(len(content)) {
+		t.Fatalf("progress = %+v", msg)
+	}
+	send(Message{Type: "file-data", Transfer: "up", Payload: content[:50000]})
+	send(Message{Type: "file-data", Transfer: "up", Payload: content[50000:]})
+	if msg := readJSON(t, conn, "transferred"); msg.Transfer != "up" || msg.Bytes != int64(len(content)) {
+		t.Fatalf("transferred = %+v", msg)
+	}
+	info, err := os.Stat(filepath.Join(dir, "upload.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*syscall.Stat_t); st.Uid != 65534 || info.Size() != int64(len(content)) {
+		t.Fatalf("uploaded file uid %d size %d", st.Uid, info.Size())
+	}
+
+	// Existing files are not replaced
+	send(Message{Type: "upload", Transfer: "again", Name: "upload.txt", Size: 1, SHA256: hex.EncodeToString(sum[:])})
+	send(Message{Type: "file-data", Transfer: "again", Payload: []byte("x")})
+	if msg := readJSON(t, conn, "error"); msg.Transfer != "again" {
+		t.Fatalf("error = %+v", msg)
+	}
+
+	// A bad checksum removes the upload
+	send(Message{Type: "upload", Transfer: "bad", Name: "bad.txt", Size: 3, SHA256: hex.EncodeToString(sum[:])})
+	send(Message{Type: "file-data", Transfer: "bad", Payload: []byte("abc")})
+	if msg := readJSON(t, conn, "error"); msg.Transfer != "bad" || msg.Message != errChecksumMismatch.Error() {
+		t.Fatalf("error = %+v", msg)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.txt")); !os.IsNotExist(err) {
+		t.Fatalf("bad upload left behind: %v", err)
+	}
+
+	// Download the file back, within the flow control window
+	send(Message{Type: "download", Transfer: "down", Name: "upload.txt"})
+	var got []byte
+	for done := false; !done; {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		switch msg.Type {
+		case "file-data":
+			if len(msg.Payload) > 4096 {
+				t.Fatalf("%d bytes sent in a window of 4096", len(msg.Payload))
+			}
+			got = append(got, msg.Payload...)
+			send(Message{Type: "ack", Bytes: int64(len(msg.Payload))})
+		case "transferred":
+			if msg.SHA256 != hex.EncodeToString(sum[:]) || msg.Bytes != int64(len(content)) {
+				t.Fatalf("transferred = %+v", msg)
+			}
+			done = true
+		case "error":
+			t.Fatalf("download failed: %s", msg.Message)
+		}
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %d bytes, want the %d uploaded", len(got), len(content))
+	}
+
+	// Files the session user cannot read stay out of reach
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("root only"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	send(Message{Type: "download", Transfer: "secret", Name: secret})
+	if msg := readJSON(t, conn, "error"); msg.Transfer != "secret" || !strings.Contains(msg.Message, "Permission denied") {
+		t.Fatalf("error = %+v", msg)
+	}
+
+	// Nobody is logged in on a terminal running the launcher itself
+	_, srv = newTestServer(t, cfg)
+	conn = dial(t, srv, "mode=json")
+	readJSON(t, conn, "session")
+	send(Message{Type: "download", Transfer: "none", Name: "/etc/hostname"})
+	if msg := readJSON(t, conn, "error"); msg.Message != errNotLoggedIn.Error() {
+		t.Fatalf("error = %+v", msg)
+	}
+
+	// A shell running as root is not enough unless root logged in
+	if uid, err := loginUID(os.Getpid()); err != nil || uid == 0 {
+		t.Skip("the test itself runs with root's login UID")
+	}
+	h, srv = newTestServer(t, cfg)
+	h.sessions.selectLauncher = func(systemd.LoginStrategy) (systemd.LoginLauncher, error) {
+		return sessionLauncher{script: "exec cat"}, nil
+	}
+	conn = dial(t, srv, "mode=json")
+	readJSON(t, conn, "session")
+	send(Message{Type: "data", Payload: []byte("x\n")})
+	for out := []byte{}; bytes.Count(out, []byte("x")) < 2; {
+		out = append(out, readJSON(t, conn, "data").Payload...)
+	}
+	send(Message{Type: "download", Transfer: "root", Name: "/etc/hostname"})
+	if msg := readJSON(t, conn, "error"); msg.Message != errRootTransfer.Error() {
+		t.Fatalf("error = %+v", msg)
+	}
+}
+
+// sessionLauncher runs a shell stand-in in a session of its own, the way
+// login starts the user's shell, and waits for it. The launcher exits with
+// the number of the signal that killed the stand-in.
+type sessionLauncher struct{ script string }
+
+func (sessionLauncher) Name() string { return "session" }
+
+func (l sessionLauncher) Launch(ctx context.Context, slave *os.File) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, "setsid", "-c", "-w", "sh", "-c", l.script)
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	return cmd, nil
+}
+
+// waitForLogin waits until the only session of h has a login session on
+// its terminal.
+func waitForLogin(t *testing.T, h *Handler) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if sessions := h.sessions.list(); len(sessions) == 1 {
+			s := sessions[0]
+			s.mu.Lock()
+			_, err := s.loginSession()
+			s.mu.Unlock()
+			if err == nil {
+				return
+			}
+		}
+	}
+	t.Fatal("no login session on the terminal")
+}
+
+func TestSignalMessage(t *testing.T) {
+	// Nothing is signalled before login, least of all the launcher
+	_, srv := newTestServer(t, DefaultConfig())
+	conn := dial(t, srv, "mode=json")
+	readJSON(t, conn, "session")
+	if err := conn.WriteJSON(Message{Type: "signal", Signal: "INT"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, conn, "error"); !strings.Contains(msg.Message, errNotLoggedIn.Error()) {
+		t.Fatalf("error = %q, want not logged in", msg.Message)
+	}
+
+	for _, tt := range []struct {
+		target, script string
+	}{
+		{"", "exec cat"},
+		// The background job shares the stand-in's session, not its process group
+		{signalSession, "set -m; sleep 60 & exec cat"},
+	} {
+		h, srv := newTestServer(t, DefaultConfig())
+		h.sessions.selectLauncher = func(systemd.LoginStrategy) (systemd.LoginLauncher, error) {
+			return sessionLauncher{script: tt.script}, nil
+		}
+		conn := dial(t, srv, "mode=json")
+		readJSON(t, conn, "session")
+		waitForLogin(t, h)
+		// The stand-in may not have exec'd cat yet, and the shell can lose
+		// a signal that arrives meanwhile. Once input comes back from cat
+		// as well as the tty echo, it has.
+		if err := conn.WriteJSON(Message{Type: "data", Payload: []byte("x\n")}); err != nil {
+			t.Fatal(err)
+		}
+		for out := []byte{}; bytes.Count(out, []byte("x")) < 2; {
+			out = append(out, readJSON(t, conn, "data").Payload...)
+		}
+
+		// STOP is not in the default allowlist
+		if err := conn.WriteJSON(Message{Type: "signal", Signal: "STOP", Target: tt.target}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := readJSON(t, conn, "error"); !strings.Contains(msg.Message, "not allowed") {
+			t.Fatalf("error = %q, want not allowed", msg.Message)
+		}
+
+		// Delivered directly, whatever the terminal mode, to the stand-in
+		// rather than the launcher
+		if err := conn.WriteJSON(Message{Type: "signal", Signal: "sigint", Target: tt.target}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := readJSON(t, conn, "exit"); msg.Signal != "" || msg.Code == nil || *msg.Code != int(syscall.SIGINT) {
+			t.Fatalf("target %q: exit = %+v, want the launcher to report SIGINT", tt.target, msg)
+		}
+	}
+
+	// Clients without a subprotocol predate signals: the text is input
+	legacy := dial(t, srv, "")
+	request := `{"type":"signal","signal":"INT"}`
+	if err := legacy.WriteMessage(websocket.TextMessage, []byte(request+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	for out := []byte{}; bytes.Count(out, []byte(request)) < 2; {
+		messageType, data, err := legacy.ReadMessage()
+		if err != nil || messageType != websocket.BinaryMessage {
+			t.Fatalf("legacy message = %d %q, %v; want output", messageType, data, err)
+		}
+		out = append(out, data...)
+	}
+
+	if _, err := ParseSignalPolicy("INT,BOGUS"); err == nil {
+		t.Error("ParseSignalPolicy accepted an unknown signal")
+	}
+}
+
+// failingLauncher runs a shell that exits with status 1 and reports it as
+// a launcher failure, like systemd-run denied by polkit.
+type failingLauncher struct{}
+
+func (failingLauncher) Name() string { return "failing" }
+
+func (failingLauncher) Launch(ctx context.Context, slave *os.File) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", "exit 1")
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	return cmd, nil
+}
+
+func (failingLauncher) Failed(state *os.ProcessState, ran time.Duration) bool {
+	return state.ExitCode() != 0
+}
+
+func TestExitStatus(t *testing.T) {
+	h, srv := newTestServer(t, DefaultConfig())
+
+	// Killed by a signal: no code, the signal and a distinct close reason
+	conn := dial(t, srv, "mode=json")
+	readJSON(t, conn, "session")
+	if err := h.sessions.list()[0].cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	msg := readJSON(t, conn, "exit")
+	if msg.Code != nil || msg.Signal != "KILL" || msg.LauncherFailed || msg.Launcher != "cat" {
+		t.Fatalf("exit = %+v, want signal KILL from cat", msg)
+	}
+	_, _, err := conn.ReadMessage()
+	if ce := (*websocket.CloseError)(nil); !errors.As(err, &ce) || ce.Code != websocket.CloseNormalClosure || ce.Text != "killed by signal KILL" {
+		t.Fatalf("close = %v", err)
+	}
+
+	// The launcher itself failed; binary mode clients get the exit message too
+	h, srv = newTestServer(t, DefaultConfig())
+	h.sessions.selectLauncher = func(systemd.LoginStrategy) (systemd.LoginLauncher, error) {
+		return failingLauncher{}, nil
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{protocolBinary}
+	conn, _, err = dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	msg = readJSON(t, conn, "exit")
+	if msg.Code == nil || *msg.Code != 1 || !msg.LauncherFailed {
+		t.Fatalf("exit = %+v, want launcher failure", msg)
+	}
+	_, _, err = conn.ReadMessage()
+	if ce := (*websocket.CloseError)(nil); !errors.As(err, &ce) || ce.Code != closeLauncherFailed || ce.Text != closeReasonLauncherFailed {
+		t.Fatalf("close = %v", err)
+	}
+
+	// Legacy clients only see the close frame
+	conn = dial(t, srv, "")
+	_, _, err = conn.ReadMessage()
+	if ce := (*websocket.CloseError)(nil); !errors.As(err, &ce) || ce.Code != closeLauncherFailed {
+		t.Fatalf("legacy client: %v, want launcher failure close", err)
+	}
+}
+
+func readMessage(t *testing.T, data []byte) Message {
+	t.Helper()
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("invalid JSON message %q: %v", data, err)
+	}
+	return msg
+}
+
+func TestMuxChannelLimit(t *testing.T) {
+	_, srv := newTestServer(t, DefaultConfig())
+	conn := dial(t, srv, "mode=mux")
+	if err := conn.WriteJSON(Message{Type: "open", Channel: 1}); err != nil {
+		t.Fatal(err)
+	}
+	view := readJSON(t, conn, "opened").View
+	// Viewers count too, and need no login process of their own
+	for id := uint32(2); id <= maxMuxChannels; id++ {
+		if err := conn.WriteJSON(Message{Type: "open", Channel: id, View: view}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := readJSON(t, conn, "opened"); msg.Channel != id {
+			t.Fatalf("opened = %+v, want channel %d", msg, id)
+		}
+	}
+	if err := conn.WriteJSON(Message{Type: "open", Channel: maxMuxChannels + 1, View: view}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, conn, "error"); msg.Channel != maxMuxChannels+1 || !strings.Contains(msg.Message, "channels per connection") {
+		t.Fatalf("error = %+v", msg)
+	}
+
+	// Closing a channel makes room again
+	if err := conn.WriteJSON(Message{Type: "close", Channel: 2}); err != nil {
+		t.Fatal(err)
+	}
+	readJSON(t, conn, "closed")
+	if err := conn.WriteJSON(Message{Type: "open", Channel: maxMuxChannels + 1, View: view}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, conn, "opened"); msg.Channel != maxMuxChannels+1 {
+		t.Fatalf("opened = %+v", msg)
+	}
+}
+
+func TestMuxModeChannels(t *testing.T) {
+	_, srv := newTestServer(t, DefaultConfig())
+	conn := dial(t, srv, "mode=mux")
+
+	for _, id := range []uint32{1, 2} {
+		if err := conn.WriteJSON(Message{Type: "open", Channel: id}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := readJSON(t, conn, "opened"); msg.Channel != id || msg.Session == "" {
+			t.Fatalf("opened = %+v, want channel %d with a session", msg, id)
+		}
+	}
+
+	frame := append([]byte{0, 0, 0, 2}, "two\n"...)
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	for !bytes.Contains(out, []byte("two")) {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read output: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		if id := binary.BigEndian.Uint32(data); id != 2 {
+			t.Fatalf("output on channel %d, want 2", id)
+		}
+		out = append(out, data[muxHeaderSize:]...)
+	}
+
+	if err := conn.WriteJSON(Message{Type: "close", Channel: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, conn, "closed"); msg.Channel != 1 || msg.Reason != closeReasonClient {
+		t.Fatalf("closed = %+v", msg)
+	}
+
+	if err := conn.WriteJSON(Message{Type: "resize", Channel: 1, Cols: 80, Rows: 24}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, conn, "error"); msg.Channel != 1 {
+		t.Fatalf("error = %+v, want channel 1", msg)
+	}
+}
+
+func TestViewerIsReadOnly(t *testing.T) {
+	_, srv := newTestServer(t, DefaultConfig())
+	owner := dial(t, srv, "mode=json")
+	id := readJSON(t, owner, "session").Session
+
+	viewer := dial(t, srv, "mode=json&role=viewer&session="+id)
+	readJSON(t, viewer, "session")
+	if msg := readJSON(t, owner, "join"); msg.Viewers != 1 {
+		t.Fatalf("join = %+v, want 1 viewer", msg)
+	}
+
+	if err := viewer.WriteJSON(Message{Type: "data", Payload: []byte("nope\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, viewer, "error"); !strings.Contains(msg.Message, "read-only") {
+		t.Fatalf("error = %q, want read-only rejection", msg.Message)
+	}
+	if err := viewer.WriteJSON(Message{Type: "resize", Cols: 10, Rows: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, viewer, "error"); !strings.Contains(msg.Message, "read-only") {
+		t.Fatalf("error = %q, want read-only rejection", msg.Message)
+	}
+	if err := viewer.WriteJSON(Message{Type: "signal", Signal: "INT"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, viewer, "error"); !strings.Contains(msg.Message, "read-only") {
+		t.Fatalf("error = %q, want read-only rejection", msg.Message)
+	}
+}
+
+func TestSessionRecording(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RecordDir = t.TempDir()
+	_, srv := newTestServer(t, cfg)
+	conn := dial(t, srv, "mode=json")
+	readJSON(t, conn, "session")
+
+	if err := conn.WriteJSON(Message{Type: "resize", Cols: 120, Rows: 40}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(Message{Type: "data", Payload: []byte("recorded\n\x04")}); err != nil {
+		t.Fatal(err)
+	}
+	readJSON(t, conn, "exit")
+
+	files, err := filepath.Glob(filepath.Join(cfg.RecordDir, "*.cast"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("recordings = %v, %v", files, err)
+	}
+	// The recording is closed once the session has been torn down
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte(`"r","120x40"`)) && bytes.Contains(data, []byte("recorded")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recording missing events:\n%s", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPlaybackFromOffset(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := recording.Create(dir, recording.Metadata{Session: "p", Start: time.Now()}, 90, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"one ", "two ", "three"} {
+		if err := rec.Output([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := recording.List(dir)
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("List() = %v, %v", infos, err)
+	}
+
+	srv := httptest.NewServer(NewPlaybackHandler(dir, DefaultConfig()))
+	defer srv.Close()
+	conn := dial(t, srv, "name="+infos[0].Name+"&offset=100")
+
+	if msg := readJSON(t, conn, "resize"); msg.Cols != 90 || msg.Rows != 20 {
+		t.Fatalf("initial size = %+v", msg)
+	}
+	var out []byte
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Fatalf("read: %v", err)
+			}
+			break
+		}
+		if messageType == websocket.BinaryMessage {
+			out = append(out, data...)
+		}
+	}
+	if want := terminalReset + "one two three"; string(out) != want {
+		t.Fatalf("played %q, want %q", out, want)
+	}
+}
+
+func TestPlaybackFiltersOutput(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := recording.Create(dir, recording.Metadata{Session: "f", Start: time.Now()}, 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A clipboard write split across events, and a title report query
+	for _, s := range []string{"before\x1b]52;c;aGVs", "bG8=\x07after", "\x1b[21t end"} {
+		if err := rec.Output([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := recording.List(dir)
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("List() = %v, %v", infos, err)
+	}
+
+	srv := httptest.NewServer(NewPlaybackHandler(dir, DefaultConfig()))
+	defer srv.Close()
+	// Fast-forwarded and played in real time
+	for _, offset := range []string{"100", "0"} {
+		conn := dial(t, srv, "name="+infos[0].Name+"&offset="+offset)
+		var out []byte
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					t.Fatalf("read: %v", err)
+				}
+				break
+			}
+			switch messageType {
+			case websocket.BinaryMessage:
+				out = append(out, data...)
+			case websocket.TextMessage:
+				if msg := readMessage(t, data); msg.Type != "resize" {
+					t.Errorf("offset %s: unexpected message %+v", offset, msg)
+				}
+			}
+		}
+		if want := terminalReset + "beforeafter end"; string(out) != want {
+			t.Errorf("offset %s: played %q, want %q", offset, out, want)
+		}
+	}
+}
+
+func TestPlaybackOnlyForRecordedUser(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := recording.Create(dir, recording.Metadata{Session: "o", User: "alice", Realm: "htpasswd", Start: time.Now()}, 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := recording.List(dir)
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("List() = %v, %v", infos, err)
+	}
+
+	cfg := DefaultConfig()
+	if cfg.Recordings, err = ParseRecordingPolicy("oidc:auditor"); err != nil {
+		t.Fatal(err)
+	}
+	var ident *auth.Identity
+	playback := NewPlaybackHandler(dir, cfg)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		playback.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), ident)))
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		ident *auth.Identity
+		want  bool
+	}{
+		{&auth.Identity{Name: "alice", Method: "form"}, true},
+		{&auth.Identity{Name: "auditor", Method: "oidc"}, true},
+		{&auth.Identity{Name: "bob", Method: "basic"}, false},
+		{&auth.Identity{Name: "alice", Method: "jwt"}, false},
+		{nil, false},
+	} {
+		ident = tt.ident
+		resp, err := http.Get(srv.URL + "/?name=" + infos[0].Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// Permitted requests get as far as the upgrade
+		if got := resp.StatusCode != http.StatusNotFound; got != tt.want {
+			t.Errorf("%v: status = %d, want permitted %v", tt.ident, resp.StatusCode, tt.want)
+		}
+	}
+	if _, err := ParseRecordingPolicy("auditor"); err == nil {
+		t.Error("expected unqualified administrator to be rejected")
+	}
+}
+
+func TestPlaybackRejectsBadRequests(t *testing.T) {
+	srv := httptest.NewServer(NewPlaybackHandler(t.TempDir(), DefaultConfig()))
+	defer srv.Close()
+
+	for query, status := range map[string]int{
+		"name=../etc/passwd":         http.StatusBadRequest,
+		"name=missing.cast":          http.StatusNotFound,
+		"name=missing.cast&speed=-1": http.StatusBadRequest,
+	} {
+		resp, err := http.Get(srv.URL + "/?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s: status = %d, want %d", query, resp.StatusCode, status)
+		}
+	}
+}
+
+func TestNegotiateFlow(t *testing.T) {
+	for _, tt := range []struct{ requested, max, want int64 }{
+		{65536, DefaultFlowWindow, 65536},
+		{1 << 30, DefaultFlowWindow, DefaultFlowWindow},
+		{100, DefaultFlowWindow, minFlowWindow},
+		{65536, 1024, 1024}, // the configured maximum wins over minFlowWindow
+		{65536, 0, 0},
+		{0, DefaultFlowWindow, 0},
+	} {
+		if got := negotiateFlow(tt.requested, tt.max); got != tt.want {
+			t.Errorf("negotiateFlow(%d, %d) = %d, want %d", tt.requested, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestFlowControlPausesOutputUntilAck(t *testing.T) {
+	_, srv := newTestServer(t, DefaultConfig())
+	conn := dial(t, srv, "flow=4096")
+	if msg := readJSON(t, conn, "flow"); msg.Window != 4096 {
+		t.Fatalf("negotiated window = %d, want 4096", msg.Window)
+	}
+
+	// Read output in the background; a timed out read would break the connection
+	output := make(chan []byte, 1024)
+	go func() {
+		defer close(output)
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if messageType == websocket.BinaryMessage {
+				output <- data
+			}
+		}
+	}()
+
+	line := strings.Repeat("x", 999) + "\n"
+	for i := 0; i < 20; i++ {
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("done\n")); err != nil {
+		t.Fatal(err)
+	}
+	// The tty echoes each line and cat prints it again. Echoes may be
+	// dropped by the kernel while output is paused, so only cat's copy counts.
+	const want = 20 * 999
+	done := false
+
+	xs := 0
+	drain := func(wait time.Duration) int {
+		n := 0
+		timeout := time.After(wait)
+		for {
+			select {
+			case data, ok := <-output:
+				if !ok {
+					t.Fatal("connection closed")
+				}
+				n += len(data)
+				xs += bytes.Count(data, []byte("x"))
+				done = done || bytes.Contains(data, []byte("done"))
+			case <-timeout:
+				return n
+			}
+		}
+	}
+
+	// Without acks the server stops after roughly one window
+	received := drain(300 * time.Millisecond)
+	if done {
+		t.Fatalf("received all output (%d bytes) without acknowledging", received)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for xs < want || !done {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d of %d characters after acknowledging", xs, want)
+		}
+		if err := conn.WriteJSON(Message{Type: "ack", Bytes: int64(received)}); err != nil {
+			t.Fatal(err)
+		}
+		received = drain(50 * time.Millisecond)
+	}
+}
+
+// recordingSink collects frames written by ptyToWebSocket.
+type recordingSink struct {
+	frames chan []byte
+}
+
+func (s recordingSink) sendData(data []byte) error {
+	s.frames <- append([]byte(nil), data...)
+	return nil
+}
+
+func (s recordingSink) sendEvent(Message) error { return nil }
+
+func TestCoalescingMergesBursts(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CoalesceDelay = 50 * time.Millisecond
+	stats := &outputStats{}
+	sub := newSubscriber(false, "test")
+	sink := recordingSink{frames: make(chan []byte, 64)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- ptyToWebSocket(ctx, sub, sink, nil, nil, newCoalescer(cfg, stats))
+	}()
+
+	// Output after a quiet period (e.g. an echoed keystroke) is sent at once
+	sub.out <- []byte("a")
+	select {
+	case frame := <-sink.frames:
+		if string(frame) != "a" {
+			t.Fatalf("first frame = %q, want %q", frame, "a")
+		}
+	case <-time.After(cfg.CoalesceDelay / 2):
+		t.Fatal("echo was delayed")
+	}
+
+	// A burst right after it is merged into one frame
+	for i := 0; i < 10; i++ {
+		sub.out <- []byte("b")
+	}
+	select {
+	case frame := <-sink.frames:
+		if string(frame) != strings.Repeat("b", 10) {
+			t.Fatalf("burst frame = %q, want 10 merged reads", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("burst was not flushed")
+	}
+
+	close(sub.out)
+	if err := <-done; err != io.EOF {
+		t.Fatalf("ptyToWebSocket returned %v, want io.EOF", err)
+	}
+	got := stats.snapshot()
+	if got.OutputReads != 11 || got.OutputFrames != 2 || got.FramesSaved != 9 {
+		t.Fatalf("stats = %+v, want 11 reads in 2 frames", got)
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Compression = true
+	h, srv := newTestServer(t, cfg)
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	line := strings.Repeat("y", 4000) + "\n"
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte(line)); err != nil {
+		t.Fatal(err)
+	}
+	// The tty echoes the line and cat prints it again
+	for ys := 0; ys < 2*4000; {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("received %d characters: %v", ys, err)
+		}
+		if messageType == websocket.BinaryMessage {
+			ys += bytes.Count(data, []byte("y"))
+		}
+	}
+
+	// Statistics are recorded just after each frame is written
+	var s SessionStats
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		stats := h.Stats(nil)
+		if len(stats.Sessions) != 1 {
+			t.Fatalf("got %d sessions, want 1", len(stats.Sessions))
+		}
+		s = stats.Sessions[0]
+		if s.RawBytes >= 2*4000 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("raw bytes = %d, want at least %d", s.RawBytes, 2*4000)
+		}
+	}
+	if s.WireBytes == 0 || s.WireBytes > s.RawBytes/4 {
+		t.Fatalf("wire bytes = %d for %d raw bytes, want compressed output", s.WireBytes, s.RawBytes)
+	}
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	_, srv := newTestServer(t, DefaultConfig())
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	// The first supported offer wins and selects the JSON protocol
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{"wsconsole.json.v9", protocolJSON, protocolBinary}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.Subprotocol(); got != protocolJSON {
+		t.Fatalf("negotiated %q, want %q", got, protocolJSON)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	readJSON(t, conn, "session")
+	if err := conn.WriteJSON(Message{Type: "data", Payload: []byte("json\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, conn, "data"); !bytes.Contains(msg.Payload, []byte("json")) {
+		t.Fatalf("unexpected output %q", msg.Payload)
+	}
+
+	// The binary protocol does not mistake text frames for input
+	dialer.Subprotocols = []string{protocolBinary}
+	bin, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bin.Close()
+	if err := bin.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bin.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, bin, "error"); !strings.Contains(msg.Message, "control") {
+		t.Fatalf("unexpected error %q", msg.Message)
+	}
+
+	// Only unknown offers: rejected before the upgrade
+	dialer.Subprotocols = []string{"wsconsole.binary.v9"}
+	_, resp, err := dialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("dial succeeded with an unknown subprotocol")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("response = %v, want 400 Bad Request", resp)
+	}
+}
+
+// readTTYD reads ttyd frames until one with the given command arrives.
+func readTTYD(t *testing.T, conn *websocket.Conn, command byte) []byte {
+	t.Helper()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for ttyd command %q: %v", command, err)
+		}
+		if len(data) > 0 && data[0] == command {
+			return data[1:]
+		}
+	}
+}
+
+func TestTTYDProtocol(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TTYDCredential = "admin:secret"
+	h, srv := newTestServer(t, cfg)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{protocolTTYD}
+
+	// A wrong token is rejected
+	bad, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	if err := bad.WriteMessage(websocket.BinaryMessage, []byte(`{"AuthToken":"wrong","columns":80,"rows":24}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bad.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("read error = %v, want policy violation", err)
+	}
+
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	handshake, _ := json.Marshal(ttydInit{AuthToken: ttydToken(cfg.TTYDCredential), Columns: 100, Rows: 30})
+	if err := conn.WriteMessage(websocket.BinaryMessage, handshake); err != nil {
+		t.Fatal(err)
+	}
+	if title := readTTYD(t, conn, ttydSetTitle); !strings.HasPrefix(string(title), "login") {
+		t.Fatalf("unexpected title %q", title)
+	}
+	readTTYD(t, conn, ttydSetPreferences)
+
+	sessions := h.sessions.list()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	rows, cols, err := creackpty.Getsize(sessions[0].ptyMaster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols != 100 || rows != 30 {
+		t.Fatalf("PTY size = %dx%d, want 100x30", cols, rows)
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("0ttyd\n")); err != nil {
+		t.Fatal(err)
+	}
+	var output []byte
+	for !bytes.Contains(output, []byte("ttyd")) {
+		output = append(output, readTTYD(t, conn, ttydOutput)...)
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte(`1{"columns":120,"rows":40}`)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		rows, cols, err := creackpty.Getsize(sessions[0].ptyMaster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cols == 120 && rows == 40 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("PTY size = %dx%d after resize, want 120x40", cols, rows)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestK8sChannelProtocol(t *testing.T) {
+	h, srv := newTestServer(t, DefaultConfig())
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{protocolK8s}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("\x04"+`{"Width":90,"Height":20}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("\x00k8s\n")); err != nil {
+		t.Fatal(err)
+	}
+	var stdout []byte
+	for !bytes.Contains(stdout, []byte("k8s")) {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 0 && data[0] == k8sStdout {
+			stdout = append(stdout, data[1:]...)
+		}
+	}
+	rows, cols, err := creackpty.Getsize(h.sessions.list()[0].ptyMaster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols != 90 || rows != 20 {
+		t.Fatalf("PTY size = %dx%d, want 90x20", cols, rows)
+	}
+
+	// EOF ends cat; the exit status arrives on the error stream
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("\x00\x04")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("no exit status before close: %v", err)
+		}
+		if len(data) > 0 && data[0] == k8sError {
+			var status k8sStatus
+			if err := json.Unmarshal(data[1:], &status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != "Success" {
+				t.Fatalf("status = %+v, want Success", status)
+			}
+			return
+		}
+	}
+}
+
+func TestK8sExitStatus(t *testing.T) {
+	code := 3
+	status := k8sExitStatus(&code)
+	if status.Status != "Failure" || status.Reason != "NonZeroExitCode" ||
+		status.Details == nil || status.Details.Causes[0].Message != "3" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestOriginPolicy(t *testing.T) {
+	policy, err := ParseOriginPolicy("https://app.example.com, https://*.corp.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},                           // not a browser
+		{"https://console.local:6001", true}, // same origin
+		{"https://app.example.com", true},    // exact
+		{"http://app.example.com", false},    // scheme differs
+		{"https://a.b.corp.example", true},   // wildcard subdomain
+		{"https://corp.example", false},      // wildcard excludes the apex
+		{"https://evilcorp.example", false},  // not a subdomain
+		{"https://attacker.example.net", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "https://console.local:6001/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := policy.allowed(r); got != tc.want {
+			t.Errorf("origin %q: allowed = %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+
+	if _, err := ParseOriginPolicy("example.com"); err == nil {
+		t.Error("origin without scheme was accepted")
+	}
+}
+
+func TestCrossOriginAndCSRFRejected(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CSRF = true
+	_, srv := newTestServer(t, cfg)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	header := http.Header{"Origin": {"https://attacker.example"}}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, header); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-origin request: err = %v, response = %v, want 403", err, resp)
+	}
+
+	// Same origin without the token echoed from the cookie
+	header = http.Header{"Origin": {srv.URL}, "Cookie": {CSRFCookie + "=token"}}
+	if _, resp, err := websocket.DefaultDialer.Dial(url+"?csrf=wrong", header); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bad CSRF token: err = %v, response = %v, want 403", err, resp)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?mode=json&csrf=token", header)
+	if err != nil {
+		t.Fatalf("valid CSRF token rejected: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	readJSON(t, conn, "session")
+}
+
+func TestIdentityConstrainsSession(t *testing.T) {
+	h := NewHandler(DefaultConfig())
+	h.sessions.selectLauncher = selectCat
+	ident := &auth.Identity{Name: "alice", Method: "jwt", Launcher: "systemd-run", MaxLifetime: time.Second}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), ident)))
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		h.Close()
+	})
+
+	// The identity's launcher cannot be overridden
+	conn := dial(t, srv, "mode=json&launcher=direct")
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("err = %v, want policy violation close", err)
+	}
+
+	// The identity's lifetime limit is applied to the session
+	conn = dial(t, srv, "mode=json")
+	readJSON(t, conn, "session")
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) || ce.Text != errLifetimeExceeded.Error() {
+				t.Fatalf("err = %v, want close with %q", err, errLifetimeExceeded)
+			}
+			return
+		}
+	}
+}
+
+func TestLauncherPolicy(t *testing.T) {
+	p, err := ParseLauncherPolicy("direct=htpasswd:alice, cert:bob; systemd-run=*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &auth.Identity{Name: "alice", Method: "form"}
+	carol := &auth.Identity{Name: "carol", Method: "basic"}
+	tests := []struct {
+		launcher string
+		ident    *auth.Identity
+		want     bool
+	}{
+		{"direct", alice, true},
+		{"direct", &auth.Identity{Name: "alice", Method: "jwt"}, false},
+		{"direct", carol, false},
+		{"direct", nil, false},
+		{"systemd-run", carol, true},
+		{"systemd-run", nil, false},
+		{"cat", nil, true},
+	}
+	for _, tt := range tests {
+		if got := p.permits(tt.launcher, tt.ident); got != tt.want {
+			t.Errorf("permits(%q, %v) = %v, want %v", tt.launcher, tt.ident, got, tt.want)
+		}
+	}
+	for _, spec := range []string{"direct", "direct=alice"} {
+		if _, err := ParseLauncherPolicy(spec); err == nil {
+			t.Errorf("ParseLauncherPolicy(%q): expected error", spec)
+		}
+	}
+
+	// Rejected identities never start a login process
+	cfg := DefaultConfig()
+	cfg.Launchers, _ = ParseLauncherPolicy("cat=htpasswd:alice")
+	h := NewHandler(cfg)
+	h.sessions.selectLauncher = selectCat
+	for _, ident := range []*auth.Identity{carol, alice} {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		sess, _, err := h.openSession("", "", "", r.WithContext(auth.WithIdentity(r.Context(), ident)))
+		if ident == carol {
+			if !errors.Is(err, errLauncherNotAllowed) {
+				t.Fatalf("carol: err = %v, want launcher not allowed", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats := sess.stats(); stats.User != "alice" {
+			t.Errorf("session user = %q, want alice", stats.User)
+		}
+	}
+	h.Close()
+}
+
+func TestReattachRequiresSameIdentity(t *testing.T) {
+	h := NewHandler(DefaultConfig())
+	h.sessions.selectLauncher = selectCat
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() {
+		srv.Close()
+		h.Close()
+	})
+	open := func(id string, ident *auth.Identity) (*session, error) {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		if ident != nil {
+			r = r.WithContext(auth.WithIdentity(r.Context(), ident))
+		}
+		sess, _, err := h.openSession(id, "", "", r)
+		return sess, err
+	}
+
+	alice := &auth.Identity{Name: "alice", Method: "basic"}
+	sess, err := open("", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open(sess.id, &auth.Identity{Name: "alice", Method: "basic"}); err != nil {
+		t.Fatalf("alice reattach: %v", err)
+	}
+
+	// Neither another user, the same name from another realm, nor an
+	// anonymous client can take the session over or watch it, whatever the role
+	for _, ident := range []*auth.Identity{{Name: "bob", Method: "basic"}, {Name: "alice", Method: "jwt"}, nil} {
+		if _, err := open(sess.id, ident); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("reattach as %v: err = %v, want session not found", ident, err)
+		}
+	}
+	conn := dial(t, srv, "mode=json&role=viewer&session="+sess.id)
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, closeSessionNotFound) {
+		t.Fatalf("anonymous viewer: err = %v, want unknown session", err)
+	}
+
+	// Statistics only describe the session to its owner; everyone else
+	// sees the byte counts alone
+	if s := h.Stats(alice).Sessions; len(s) != 1 || s[0].Session != sess.id || s[0].User != "alice" || s[0].Remote == "" {
+		t.Errorf("stats for alice = %+v", s)
+	}
+	for _, ident := range []*auth.Identity{{Name: "alice", Method: "cert"}, nil} {
+		s := h.Stats(ident).Sessions
+		if len(s) != 1 || s[0].Session != "" || s[0].User != "" || s[0].Remote != "" || s[0].Launcher != "cat" || !s[0].Started.Equal(sess.started) {
+			t.Errorf("stats for %v = %+v", ident, s)
+		}
+	}
+}
+
+func TestViewID(t *testing.T) {
+	h := NewHandler(DefaultConfig())
+	h.sessions.selectLauncher = selectCat
+	var ident *auth.Identity
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), ident)))
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		h.Close()
+	})
+
+	ident = &auth.Identity{Name: "alice", Method: "basic"}
+	owner := dial(t, srv, "mode=json")
+	hello := readJSON(t, owner, "hello")
+	if hello.Session == "" || hello.View == "" || hello.View == hello.Session {
+		t.Fatalf("owner hello = %+v", hello)
+	}
+
+	// Another identity joins with the view ID, whatever role it asks for,
+	// and never learns the session ID
+	ident = &auth.Identity{Name: "bob", Method: "basic"}
+	viewer := dial(t, srv, "mode=json&view="+hello.View)
+	if msg := readJSON(t, viewer, "hello"); msg.Session != "" || msg.View != hello.View || msg.Role != roleViewer {
+		t.Fatalf("viewer hello = %+v", msg)
+	}
+	if msg := readJSON(t, viewer, "session"); msg.Session != "" || msg.View != hello.View {
+		t.Fatalf("viewer session = %+v", msg)
+	}
+	if msg := readJSON(t, owner, "join"); msg.Viewers != 1 {
+		t.Fatalf("join = %+v", msg)
+	}
+	if err := viewer.WriteJSON(Message{Type: "data", Payload: []byte("nope\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, viewer, "error"); !strings.Contains(msg.Message, "read-only") {
+		t.Fatalf("error = %q, want read-only rejection", msg.Message)
+	}
+
+	// The view ID is not a session ID
+	conn := dial(t, srv, "mode=json&session="+hello.View)
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, closeSessionNotFound) {
+		t.Fatalf("view ID as session: err = %v, want unknown session", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d within burst refused", i)
+		}
+	}
+	ok, retry := l.allow("a", now)
+	if ok || retry != 500*time.Millisecond {
+		t.Fatalf("over burst: ok = %v, retry = %v", ok, retry)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("other IP limited")
+	}
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("token not refilled")
+	}
+	if newRateLimiter(0, 10) != nil {
+		t.Error("zero rate should disable limiting")
+	}
+}
+
+func TestSessionCaps(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RateLimit = 0
+	cfg.MaxSessions = 2
+	cfg.MaxSessionsPerUser = 1
+	h := NewHandler(cfg)
+	h.sessions.selectLauncher = selectCat
+	var ident *auth.Identity
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ident != nil {
+			r = r.WithContext(auth.WithIdentity(r.Context(), ident))
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		h.Close()
+	})
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?mode=json"
+
+	ident = &auth.Identity{Name: "alice", Method: "basic"}
+	readJSON(t, dial(t, srv, "mode=json"), "session")
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second session for alice: err = %v", err)
+	}
+
+	ident = &auth.Identity{Name: "bob", Method: "basic"}
+	first := readJSON(t, dial(t, srv, "mode=json"), "session")
+	ident = &auth.Identity{Name: "carol", Method: "basic"}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("session over server limit: err = %v", err)
+	}
+
+	// Reattaching does not start a session, so it is not capped
+	ident = &auth.Identity{Name: "bob", Method: "basic"}
+	if msg := readJSON(t, dial(t, srv, "mode=json&session="+first.Session), "session"); !msg.Resumed {
+		t.Error("reattach refused")
+	}
+}
+
+func TestRateLimitedUpgrade(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RateLimit = 0.001
+	cfg.RateBurst = 1
+	h := NewHandler(cfg)
+	// Requests the handler behind the limit rejects are counted too
+	var rejected bool
+	srv := httptest.NewServer(h.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rejected = true
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})))
+	t.Cleanup(func() {
+		srv.Close()
+		h.Close()
+	})
+	if resp, err := http.Get(srv.URL + "/ws"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("first request: %v", err)
+	}
+	rejected = false
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err == nil || resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("err = %v, want 429 with Retry-After", err)
+	}
+	if rejected {
+		t.Fatal("request over the limit reached the handler")
+	}
+}
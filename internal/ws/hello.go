@@ -0,0 +1,97 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"log/slog"
+
+	"github.com/danmaid/wsconsole/internal/pty"
+	"github.com/danmaid/wsconsole/internal/systemd"
+)
+
+// Capabilities listed in "hello" messages, so clients only use the features
+// enabled on their connection.
+const (
+	capResume      = "resume"      // the session survives a dropped connection (?session=<id>)
+	capFlow        = "flow"        // output flow control with "ack" messages
+	capCompression = "compression" // permessage-deflate was negotiated
+	capSignal      = "signal"      // "signal" messages are accepted
+	capRecording   = "recording"   // the session is being recorded
+	capTransfer    = "transfer"    // file transfer messages are accepted (JSON mode only)
+)
+
+// hello returns the "hello" message describing sess to the client attached
+// to it as sub, before any output is sent.
+func (h *Handler) hello(conn *wsConn, sess *session, sub *subscriber, flow *flowControl) Message {
+	msg := Message{
+		Type:     "hello",
+		Version:  h.cfg.Version,
+		Launcher: sess.launcher,
+		PTY:      sess.tty,
+	}
+	msg.Session, msg.View = sessionIDs(sess, sub)
+	msg.Cols, msg.Rows = sess.winsize()
+	msg.Title, msg.Cwd = sess.titleAndCwd()
+	if sub.viewer {
+		msg.Role = roleViewer
+	}
+	if h.cfg.SessionGrace > 0 {
+		msg.Capabilities = append(msg.Capabilities, capResume)
+	}
+	if flow.size() > 0 {
+		msg.Capabilities = append(msg.Capabilities, capFlow)
+	}
+	if conn.compressed {
+		msg.Capabilities = append(msg.Capabilities, capCompression)
+	}
+	// Signals only reach a user's session on the PTY, which systemd-run never is
+	if !sub.viewer && !h.cfg.Signals.empty() && systemd.LoginOnPTY(sess.login) {
+		msg.Capabilities = append(msg.Capabilities, capSignal)
+	}
+	if sess.recording() {
+		msg.Capabilities = append(msg.Capabilities, capRecording)
+	}
+	return msg
+}
+
+// sessionIDs returns the session ID and the view ID to tell the client
+// attached to sess as sub. Viewers only learn the view ID: the session ID
+// would let them attach as the owner.
+func sessionIDs(sess *session, sub *subscriber) (id, view string) {
+	if sub.viewer {
+		return "", sess.viewID
+	}
+	return sess.id, sess.viewID
+}
+
+// winsize returns the current terminal size, or zeros once the session
+// has exited.
+func (s *session) winsize() (cols, rows int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exited {
+		return 0, 0
+	}
+	cols, rows, err := pty.GetWinsize(s.ptyMaster.Fd())
+	if err != nil {
+		slog.Debug("failed to read window size", "session", s.id, "error", err)
+		return 0, 0
+	}
+	return cols, rows
+}
+
+// titleAndCwd returns the window title and working directory last reported
+// by the shell.
+func (s *session) titleAndCwd() (title, cwd string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.term.title, s.term.cwd
+}
+
+// recording reports whether the session output is being recorded.
+func (s *session) recording() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.recorder != nil
+}
@@ -0,0 +1,186 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocolK8s is the Kubernetes remote command protocol used by kubectl
+// exec/attach and client-go's remotecommand package.
+//
+// Every message is a binary frame whose first byte is the stream:
+//
+//	0  stdin   client to server: terminal input
+//	1  stdout  server to client: terminal output
+//	2  stderr  unused, a TTY merges it into stdout
+//	3  error   server to client: exit status as a Kubernetes Status object
+//	4  resize  client to server: {"Width":N,"Height":N}
+//
+// The session, launcher and role query parameters work as for the other
+// protocols; Kubernetes parameters such as command or tty are ignored.
+const protocolK8s = "v4.channel.k8s.io"
+
+// Kubernetes stream IDs.
+const (
+	k8sStdin  = 0
+	k8sStdout = 1
+	k8sError  = 3
+	k8sResize = 4
+)
+
+// k8sSize is the payload of the resize stream.
+type k8sSize struct {
+	Width  int `json:"Width"`
+	Height int `json:"Height"`
+}
+
+// k8sStatus is the subset of a Kubernetes metav1.Status sent on the error
+// stream when the login process ends.
+type k8sStatus struct {
+	Metadata struct{}          `json:"metadata"`
+	Status   string            `json:"status"` // "Success" or "Failure"
+	Message  string            `json:"message,omitempty"`
+	Reason   string            `json:"reason,omitempty"`
+	Details  *k8sStatusDetails `json:"details,omitempty"`
+}
+
+type k8sStatusDetails struct {
+	Causes []k8sStatusCause `json:"causes"`
+}
+
+type k8sStatusCause struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// k8sExitStatus maps the login process exit code onto the Status that
+// client-go turns into an exec.CodeExitError.
+func k8sExitStatus(code *int) k8sStatus {
+	switch {
+	case code == nil:
+		return k8sStatus{Status: "Failure", Message: "login process exit status unknown", Reason: "InternalError"}
+	case *code == 0:
+		return k8sStatus{Status: "Success"}
+	}
+	return k8sStatus{
+		Status:  "Failure",
+		Message: fmt.Sprintf("command terminated with non-zero exit code: %d", *code),
+		Reason:  "NonZeroExitCode",
+		Details: &k8sStatusDetails{Causes: []k8sStatusCause{{Reason: "ExitCode", Message: strconv.Itoa(*code)}}},
+	}
+}
+
+// serveK8s bridges a Kubernetes remote command client to a login session.
+func (h *Handler) serveK8s(ctx context.Context, cancel context.CancelFunc, conn *wsConn, r *http.Request) {
+	sess, sub, scrollback, resumed, ok := h.attachRequest(conn, r, protocolK8s)
+	if !ok {
+		return
+	}
+	defer sess.detach(sub)
+
+	sink := k8sSink{conn: conn, stats: &sess.output}
+	filter := newOutputFilter(h.cfg)
+	if len(scrollback) > 0 && (resumed || sub.viewer) {
+		scrollback, _ = filter.filter(scrollback)
+		if err := sink.sendData(scrollback); err != nil {
+			slog.Warn("failed to replay scrollback", "error", err)
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		err := ptyToWebSocket(ctx, sub, sink, nil, filter, newCoalescer(h.cfg, &h.stats))
+		if err == io.EOF {
+			if err := sink.sendStatus(k8sExitStatus(sess.exitCode())); err != nil {
+				slog.Warn("failed to send exit status", "error", err)
+			}
+		}
+		closeAfterOutput(conn, sess, err)
+	}()
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		if err := k8sToPTY(conn, sess, sub); err != nil {
+			slog.Error("WebSocket to PTY error", "error", err)
+		}
+	}()
+	wg.Wait()
+}
+
+// k8sToPTY handles the stdin and resize streams until the connection closes.
+func k8sToPTY(conn *wsConn, sess *session, sub *subscriber) error {
+	conn.SetReadLimit(maxMessageSize)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			return err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		switch data[0] {
+		case k8sStdin:
+			if err := writeInput(conn, sess, sub, data[1:], true); err != nil {
+				return err
+			}
+		case k8sResize:
+			var size k8sSize
+			if err := json.Unmarshal(data[1:], &size); err != nil {
+				slog.Debug("ignoring malformed resize stream message", "error", err)
+				continue
+			}
+			resizePTY(conn, sess, sub, Message{Cols: size.Width, Rows: size.Height}, true)
+		default:
+			slog.Debug("ignoring message on unexpected stream", "stream", data[0])
+		}
+	}
+}
+
+// k8sSink writes output on the stdout stream. The protocol has no session
+// notifications, so events are dropped.
+type k8sSink struct {
+	conn  *wsConn
+	stats *compressionStats
+}
+
+func (s k8sSink) send(stream byte, payload []byte) error {
+	frame := make([]byte, 1+len(payload))
+	frame[0] = stream
+	copy(frame[1:], payload)
+	return s.conn.writeData(websocket.BinaryMessage, frame, s.stats)
+}
+
+// sendStatus writes status on the error stream.
+func (s k8sSink) sendStatus(status k8sStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to encode status: %w", err)
+	}
+	return s.send(k8sError, data)
+}
+
+func (s k8sSink) sendData(data []byte) error {
+	return s.send(k8sStdout, data)
+}
+
+func (s k8sSink) sendEvent(Message) error {
+	return nil
+}
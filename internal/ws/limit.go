@@ -0,0 +1,187 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danmaid/wsconsole/internal/auth"
+)
+
+const (
+	// DefaultRateLimit is the sustained rate of requests allowed per
+	// remote IP, in requests per second. Behind a reverse proxy every
+	// client has the proxy's address and shares one bucket, so such
+	// deployments turn it off and limit at the proxy instead.
+	DefaultRateLimit = 1.0
+	// DefaultRateBurst is how many requests a remote IP may make in a
+	// burst, e.g. when the terminal page loads or several terminals
+	// reconnect.
+	DefaultRateBurst = 20
+	// DefaultMaxSessions and DefaultMaxSessionsPerUser cap the concurrent
+	// sessions on the server and per authenticated identity.
+	DefaultMaxSessions        = 64
+	DefaultMaxSessionsPerUser = 8
+
+	// closeTryAgainLater is the WebSocket close code for sessions refused
+	// because a session cap was reached after the upgrade.
+	closeTryAgainLater = 1013
+)
+
+var errTooManySessions = errors.New("too many sessions")
+
+// rateLimiter is a token bucket per remote IP.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket size
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing rate requests per second with
+// bursts of burst, or nil if rate is not positive.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from key's bucket. If the bucket is empty it returns
+// false and how long until the next token.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Buckets that have refilled are indistinguishable from new ones
+	if now.Sub(l.lastSweep) > time.Minute {
+		full := time.Duration(l.burst / l.rate * float64(time.Second))
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// remoteIP returns the IP address of the client that sent r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimit applies the per-IP rate limit to every request before passing
+// it to next, which is meant to include the authentication gate: requests
+// with wrong credentials are throttled like any other. Requests over the
+// limit get 429 Too Many Requests with Retry-After.
+func (h *Handler) RateLimit(next http.Handler) http.Handler {
+	if h.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, retry := h.limiter.allow(remoteIP(r), time.Now()); !ok {
+			slog.Info("rate limited request", "remote", r.RemoteAddr, "path", r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// admit applies the session caps before an upgrade, writing 429 Too Many
+// Requests and returning false when the request is refused. The caps are
+// checked again when the session starts.
+func (h *Handler) admit(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Query().Get("session") == "" && r.URL.Query().Get("view") == "" {
+		if err := h.sessions.checkCaps(userKey(auth.FromContext(r.Context()))); err != nil {
+			slog.Info("rejected WebSocket request", "remote", r.RemoteAddr, "error", err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return false
+		}
+	}
+	return true
+}
+
+// checkCaps returns errTooManySessions if user may not start another
+// session. Callers must not hold r.mu.
+func (r *registry) checkCaps(user string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.checkCapsLocked(user)
+}
+
+func (r *registry) checkCapsLocked(user string) error {
+	if max := r.cfg.MaxSessions; max > 0 && len(r.sessions)+r.starting >= max {
+		return fmt.Errorf("%w: server limit of %d reached", errTooManySessions, max)
+	}
+	if max := r.cfg.MaxSessionsPerUser; max > 0 && user != "" {
+		count := r.startingBy[user]
+		for _, s := range r.sessions {
+			if s.userKey == user {
+				count++
+			}
+		}
+		if count >= max {
+			return fmt.Errorf("%w: limit of %d for %s reached", errTooManySessions, max, user)
+		}
+	}
+	return nil
+}
+
+// reserve claims a slot for a new session of user within the caps. The
+// returned function releases it once the session is registered or has
+// failed to start.
+func (r *registry) reserve(user string) (release func(), err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkCapsLocked(user); err != nil {
+		return nil, err
+	}
+	r.starting++
+	r.startingBy[user]++
+	return func() {
+		r.mu.Lock()
+		r.starting--
+		if r.startingBy[user]--; r.startingBy[user] == 0 {
+			delete(r.startingBy, user)
+		}
+		r.mu.Unlock()
+	}, nil
+}
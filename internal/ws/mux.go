@@ -0,0 +1,372 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Multiplexed mode (?mode=mux) carries several login sessions over one
+// WebSocket. Terminal data travels in binary frames prefixed with a 4-byte
+// big-endian channel ID; control messages are JSON text frames:
+//
+//	client -> server: {"type":"open","channel":1,"launcher":"auto","window":65536}
+//	                  {"type":"open","channel":2,"session":"<id>"} (reattach)
+//	                  {"type":"open","channel":3,"view":"<view id>"} (read-only)
+//	                  {"type":"resize","channel":1,"cols":80,"rows":24}
+//	                  {"type":"ack","channel":1,"bytes":4096} (flow control)
+//	                  {"type":"signal","channel":1,"signal":"INT","target":"foreground"}
+//	                  {"type":"close","channel":1}
+//	server -> client: {"type":"opened","channel":1,"session":"<id>","view":"<view id>","resumed":false,"window":65536}
+//	                  {"type":"closed","channel":1,"reason":"exited","code":0}
+//	                  {"type":"closed","channel":1,"reason":"killed","signal":"TERM"}
+//	                  {"type":"hello","channel":1,"session":"<id>","version":"...",...} (after "opened")
+//	                  {"type":"error","channel":1,"message":"..."}
+//	                  {"type":"join","channel":3,"remote":"...","viewers":1} (also "leave")
+//	                  {"type":"warning","channel":1,"reason":"idle timeout","seconds":30}
+//
+// Channel 0 is reserved and never carries a session. A non-zero "window"
+// in "open" enables flow control for that channel (see flowControl).
+const muxHeaderSize = 4
+
+// maxMuxChannels caps the channels open at a time on one connection,
+// viewers included; each may hold a login session and its goroutines.
+const maxMuxChannels = 32
+
+// Reasons reported in "closed" messages. Sessions closed by the server
+// report errIdleTimeout or errLifetimeExceeded instead of closeReasonExited.
+const (
+	closeReasonExited         = "exited"             // the login process ended
+	closeReasonKilled         = "killed"             // the login process was killed by a signal
+	closeReasonLauncherFailed = "launcher failed"    // the launcher failed before login started
+	closeReasonClient         = "closed by client"   // the client sent "close"
+	closeReasonReplaced       = "attached elsewhere" // another connection took over the session
+	closeReasonError          = "error"              // forwarding output failed
+	closeReasonTooSlow        = "viewer too slow"    // a viewer fell too far behind the output
+)
+
+// muxChannel is one session attached to a multiplexed connection.
+type muxChannel struct {
+	id     uint32
+	sess   *session
+	sub    *subscriber
+	flow   *flowControl
+	cancel context.CancelFunc
+}
+
+// muxConn tracks the channels open on a multiplexed connection.
+type muxConn struct {
+	h    *Handler
+	conn *wsConn
+	r    *http.Request
+
+	mu       sync.Mutex
+	channels map[uint32]*muxChannel
+	wg       sync.WaitGroup
+}
+
+// serveMux runs the multiplexed protocol until the connection closes. Open
+// channels are detached, not terminated, so they can be reattached later.
+func (h *Handler) serveMux(ctx context.Context, conn *wsConn, r *http.Request) {
+	m := &muxConn{
+		h:        h,
+		conn:     conn,
+		r:        r,
+		channels: make(map[uint32]*muxChannel),
+	}
+	if err := m.readLoop(ctx); err != nil {
+		slog.Error("WebSocket to PTY error", "error", err)
+	}
+
+	m.mu.Lock()
+	for _, ch := range m.channels {
+		ch.cancel()
+		ch.sess.detach(ch.sub)
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// readLoop dispatches client frames to channels and control handlers.
+func (m *muxConn) readLoop(ctx context.Context) error {
+	m.conn.SetReadLimit(maxMessageSize)
+	for {
+		messageType, data, err := m.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Info("WebSocket closed normally")
+				return nil
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		switch messageType {
+		case websocket.BinaryMessage:
+			if len(data) < muxHeaderSize {
+				m.sendError(0, "binary frame shorter than channel header")
+				continue
+			}
+			id := binary.BigEndian.Uint32(data)
+			ch := m.channel(id)
+			if ch == nil {
+				m.sendError(id, "channel is not open")
+				continue
+			}
+			if !ch.sess.isOwner(ch.sub) {
+				m.sendError(id, "input ignored: "+errReadOnly.Error())
+				continue
+			}
+			if err := ch.sess.write(data[muxHeaderSize:]); err != nil {
+				slog.Warn("failed to write channel input", "channel", id, "error", err)
+				m.sendError(id, "failed to write input")
+			}
+		case websocket.TextMessage:
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				m.sendError(0, "invalid JSON message")
+				continue
+			}
+			m.handleControl(ctx, msg)
+		}
+	}
+}
+
+// handleControl applies an open, close, resize or signal request.
+func (m *muxConn) handleControl(ctx context.Context, msg Message) {
+	if msg.Channel == 0 {
+		m.sendError(0, "channel 0 is reserved")
+		return
+	}
+
+	switch msg.Type {
+	case "open":
+		m.open(ctx, msg)
+	case "close":
+		ch := m.remove(msg.Channel)
+		if ch == nil {
+			m.sendError(msg.Channel, "channel is not open")
+			return
+		}
+		ch.cancel()
+		ch.sess.detach(ch.sub)
+		if !ch.sub.viewer {
+			// Viewers only stop watching; the owner ends the session
+			ch.sess.close()
+		}
+		slog.Info("channel closed by client", "channel", ch.id, "session", ch.sess.id)
+		m.sendClosed(ch.id, closeReasonClient, nil)
+	case "ack":
+		ch := m.channel(msg.Channel)
+		if ch == nil {
+			m.sendError(msg.Channel, "channel is not open")
+			return
+		}
+		ch.flow.ack(msg.Bytes)
+	case "resize":
+		ch := m.channel(msg.Channel)
+		if ch == nil {
+			m.sendError(msg.Channel, "channel is not open")
+			return
+		}
+		if !ch.sess.isOwner(ch.sub) {
+			m.sendError(msg.Channel, "resize ignored: "+errReadOnly.Error())
+			return
+		}
+		if msg.Cols <= 0 || msg.Rows <= 0 {
+			m.sendError(msg.Channel, "resize requires positive cols and rows")
+			return
+		}
+		if err := ch.sess.resize(msg.Cols, msg.Rows); err != nil {
+			slog.Warn("failed to resize PTY", "channel", msg.Channel, "error", err)
+			m.sendError(msg.Channel, "failed to resize PTY")
+		}
+	case "signal":
+		ch := m.channel(msg.Channel)
+		if ch == nil {
+			m.sendError(msg.Channel, "channel is not open")
+			return
+		}
+		if err := handleSignal(ch.sess, ch.sub, msg, m.h.cfg.Signals); err != nil {
+			m.sendError(msg.Channel, err.Error())
+		}
+	default:
+		m.sendError(msg.Channel, fmt.Sprintf("unknown message type %q", msg.Type))
+	}
+}
+
+// open starts or reattaches a session on a new channel.
+func (m *muxConn) open(ctx context.Context, msg Message) {
+	if m.channel(msg.Channel) != nil {
+		m.sendError(msg.Channel, "channel is already open")
+		return
+	}
+	m.mu.Lock()
+	n := len(m.channels)
+	m.mu.Unlock()
+	if n >= maxMuxChannels {
+		slog.Info("channel refused", "channel", msg.Channel, "remote", m.r.RemoteAddr, "open", n)
+		m.sendError(msg.Channel, fmt.Sprintf("at most %d channels per connection", maxMuxChannels))
+		return
+	}
+
+	launcher := msg.Launcher
+	if launcher == "" {
+		launcher = m.r.URL.Query().Get("launcher")
+	}
+	viewer := msg.Role == roleViewer || msg.View != ""
+	if viewer && msg.Session == "" && msg.View == "" {
+		m.sendError(msg.Channel, "viewers must specify a session")
+		return
+	}
+	sess, resumed, err := m.h.openSession(msg.Session, msg.View, launcher, m.r)
+	if err != nil {
+		slog.Warn("failed to open channel", "channel", msg.Channel, "error", err)
+		m.sendError(msg.Channel, fmt.Sprintf("failed to open channel: %v", err))
+		return
+	}
+	sub, scrollback, err := attachAs(sess, viewer, m.r.RemoteAddr)
+	if err != nil {
+		m.sendError(msg.Channel, fmt.Sprintf("failed to open channel: %v", err))
+		return
+	}
+
+	chCtx, cancel := context.WithCancel(ctx)
+	flow := newFlowControl(negotiateFlow(msg.Window, m.h.cfg.FlowWindow))
+	ch := &muxChannel{id: msg.Channel, sess: sess, sub: sub, flow: flow, cancel: cancel}
+	m.mu.Lock()
+	m.channels[ch.id] = ch
+	m.mu.Unlock()
+
+	slog.Info("channel opened", "channel", ch.id, "session", sess.id, "remote", m.r.RemoteAddr, "resumed", resumed)
+	opened := Message{Type: "opened", Channel: ch.id, Resumed: resumed, Window: flow.size()}
+	opened.Session, opened.View = sessionIDs(sess, sub)
+	if err := m.conn.writeJSON(opened); err != nil {
+		slog.Warn("failed to send opened message", "error", err)
+	}
+	hello := m.h.hello(m.conn, sess, sub, flow)
+	hello.Channel = ch.id
+	if err := m.conn.writeJSON(hello); err != nil {
+		slog.Warn("failed to send hello message", "error", err)
+	}
+	sink := channelSink{m: m, id: ch.id, stats: &sess.output}
+	filter := newOutputFilter(m.h.cfg)
+	if len(scrollback) > 0 && (resumed || sub.viewer) {
+		scrollback, _ = filter.filter(scrollback)
+		if err := sink.sendData(scrollback); err != nil {
+			slog.Warn("failed to replay scrollback", "channel", ch.id, "error", err)
+		}
+		flow.sent(len(scrollback))
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		err := ptyToWebSocket(chCtx, sub, sink, flow, filter, newCoalescer(m.h.cfg, &m.h.stats))
+		if chCtx.Err() != nil {
+			// Closed by the client or the connection went away
+			return
+		}
+		m.remove(ch.id)
+		cancel()
+		switch {
+		case err == io.EOF:
+			m.sendExited(ch.id, sess)
+		case errors.Is(err, errSessionReplaced):
+			m.sendClosed(ch.id, closeReasonReplaced, nil)
+		case errors.Is(err, errViewerTooSlow):
+			m.sendClosed(ch.id, closeReasonTooSlow, nil)
+		default:
+			slog.Error("PTY to WebSocket error", "channel", ch.id, "error", err)
+			sess.detach(sub)
+			m.sendClosed(ch.id, closeReasonError, nil)
+		}
+	}()
+}
+
+func (m *muxConn) channel(id uint32) *muxChannel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.channels[id]
+}
+
+func (m *muxConn) remove(id uint32) *muxChannel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := m.channels[id]
+	delete(m.channels, id)
+	return ch
+}
+
+// sendData writes a channel-prefixed binary frame.
+func (m *muxConn) sendData(id uint32, data []byte, stats *compressionStats) error {
+	frame := make([]byte, muxHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, id)
+	copy(frame[muxHeaderSize:], data)
+	if err := m.conn.writeData(websocket.BinaryMessage, frame, stats); err != nil {
+		return fmt.Errorf("failed to send binary message: %w", err)
+	}
+	return nil
+}
+
+// channelSink frames output and events for one multiplexed channel.
+type channelSink struct {
+	m     *muxConn
+	id    uint32
+	stats *compressionStats
+}
+
+func (c channelSink) sendData(data []byte) error {
+	return c.m.sendData(c.id, data, c.stats)
+}
+
+func (c channelSink) sendEvent(msg Message) error {
+	msg.Channel = c.id
+	return c.m.conn.writeJSON(msg)
+}
+
+func (m *muxConn) sendClosed(id uint32, reason string, code *int) {
+	if err := m.conn.writeJSON(Message{Type: "closed", Channel: id, Reason: reason, Code: code}); err != nil {
+		slog.Warn("failed to send closed message", "error", err)
+	}
+}
+
+// sendExited reports that the session on channel id ended, and how.
+func (m *muxConn) sendExited(id uint32, sess *session) {
+	msg := sess.exitInfo().message()
+	msg.Type = "closed"
+	msg.Channel = id
+	msg.Launcher = ""
+	switch {
+	case sess.closedBy() != nil:
+		msg.Reason = sess.closedBy().Error()
+	case msg.LauncherFailed:
+		msg.Reason = closeReasonLauncherFailed
+	case msg.Signal != "":
+		msg.Reason = closeReasonKilled
+	default:
+		msg.Reason = closeReasonExited
+	}
+	if err := m.conn.writeJSON(msg); err != nil {
+		slog.Warn("failed to send closed message", "error", err)
+	}
+}
+
+func (m *muxConn) sendError(id uint32, message string) {
+	if err := m.conn.writeJSON(Message{Type: "error", Channel: id, Message: message}); err != nil {
+		slog.Warn("failed to send error message", "error", err)
+	}
+}
@@ -0,0 +1,187 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Operating System Command (OSC) sequences are ESC ] <command> ; <text>
+// terminated by BEL or ESC \. Shells use them to set the window title
+// (OSC 0 and 2), report the working directory (OSC 7, a file:// URL) and
+// mark prompts and commands (OSC 133, "shell integration"):
+//
+//	ESC ] 133 ; A BEL      prompt starts
+//	ESC ] 133 ; B BEL      prompt ends, the user types a command
+//	ESC ] 133 ; C BEL      the command runs
+//	ESC ] 133 ; D ; 0 BEL  the command finished with status 0
+//
+// The session scans its output for these and reports them to clients as
+// "title", "cwd" and "prompt" messages; the output itself is not changed.
+const maxOSCSize = 4096 // longer sequences are not ones we parse
+
+// oscState is where an oscParser is within the output stream.
+type oscState int
+
+const (
+	oscGround    oscState = iota // ordinary output
+	oscEscape                    // after ESC
+	oscString                    // inside ESC ] ...
+	oscStringEsc                 // after ESC inside an OSC, expecting \
+)
+
+const (
+	asciiBEL = 0x07
+	asciiESC = 0x1b
+	asciiCAN = 0x18
+	asciiSUB = 0x1a
+)
+
+// Activities reported for sessions whose shell marks prompts with OSC 133.
+const (
+	activityPrompt  = "prompt"  // the shell is waiting for a command
+	activityRunning = "running" // a command is running
+)
+
+// oscParser finds OSC sequences in output that arrives in arbitrary chunks.
+type oscParser struct {
+	state    oscState
+	buf      []byte
+	overflow bool // the current sequence exceeded maxOSCSize
+}
+
+// feed scans data and returns the events for the sequences it completes.
+func (p *oscParser) feed(data []byte) []Message {
+	var events []Message
+	for i := 0; i < len(data); i++ {
+		if p.state == oscGround {
+			j := bytes.IndexByte(data[i:], asciiESC)
+			if j < 0 {
+				return events
+			}
+			i += j
+			p.state = oscEscape
+			continue
+		}
+		c := data[i]
+		switch p.state {
+		case oscEscape:
+			switch c {
+			case ']':
+				p.state = oscString
+				p.buf = p.buf[:0]
+				p.overflow = false
+			case asciiESC:
+				// Still after ESC
+			default:
+				p.state = oscGround
+			}
+		case oscString:
+			switch c {
+			case asciiBEL:
+				events = p.dispatch(events)
+			case asciiESC:
+				p.state = oscStringEsc
+			case asciiCAN, asciiSUB:
+				p.state = oscGround
+			default:
+				if len(p.buf) < maxOSCSize {
+					p.buf = append(p.buf, c)
+				} else {
+					p.overflow = true
+				}
+			}
+		case oscStringEsc:
+			if c == '\\' {
+				events = p.dispatch(events)
+				continue
+			}
+			// Any other escape aborts the OSC and starts a new sequence
+			p.state = oscEscape
+			i--
+		}
+	}
+	return events
+}
+
+// dispatch ends the current sequence and appends its event, if any.
+func (p *oscParser) dispatch(events []Message) []Message {
+	p.state = oscGround
+	if p.overflow {
+		return events
+	}
+	if msg, ok := parseOSC(string(p.buf)); ok {
+		events = append(events, msg)
+	}
+	return events
+}
+
+// parseOSC interprets the body of an OSC sequence.
+func parseOSC(body string) (Message, bool) {
+	command, text, _ := strings.Cut(body, ";")
+	switch command {
+	case "0", "2":
+		return Message{Type: "title", Title: text}, true
+	case "7":
+		u, err := url.Parse(text)
+		if err != nil || u.Scheme != "file" || u.Path == "" {
+			return Message{}, false
+		}
+		return Message{Type: "cwd", Cwd: u.Path}, true
+	case "133":
+		mark, params, _ := strings.Cut(text, ";")
+		switch mark {
+		case "A", "B", "C":
+			return Message{Type: "prompt", Mark: mark}, true
+		case "D":
+			msg := Message{Type: "prompt", Mark: mark}
+			status, _, _ := strings.Cut(params, ";")
+			if code, err := strconv.Atoi(status); err == nil {
+				msg.Code = &code
+			}
+			return msg, true
+		}
+	}
+	return Message{}, false
+}
+
+// terminalState is what the session has learned from OSC sequences.
+type terminalState struct {
+	title      string
+	cwd        string
+	activity   string // activityPrompt or activityRunning, empty without OSC 133
+	lastStatus *int   // exit status of the last command reported by OSC 133 D
+}
+
+// apply records msg and reports whether clients should be told about it.
+// Titles and directories are only reported when they change, since many
+// shells set them at every prompt.
+func (t *terminalState) apply(msg Message) bool {
+	switch msg.Type {
+	case "title":
+		if msg.Title == t.title {
+			return false
+		}
+		t.title = msg.Title
+	case "cwd":
+		if msg.Cwd == t.cwd {
+			return false
+		}
+		t.cwd = msg.Cwd
+	case "prompt":
+		switch msg.Mark {
+		case "A", "B":
+			t.activity = activityPrompt
+		case "C":
+			t.activity = activityRunning
+		case "D":
+			t.activity = activityPrompt
+			t.lastStatus = msg.Code
+		}
+	}
+	return true
+}
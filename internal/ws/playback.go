@@ -0,0 +1,279 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/danmaid/wsconsole/internal/auth"
+	"github.com/danmaid/wsconsole/internal/recording"
+	"github.com/gorilla/websocket"
+)
+
+// terminalReset is sent before replaying from an offset so the client
+// terminal starts from a clean screen (RIS).
+const terminalReset = "\x1bc"
+
+// PlaybackHandler replays stored recordings over WebSocket using the binary
+// protocol of live sessions, so the terminal page can display them.
+//
+// Query parameters:
+//
+//	name    recording file name (required)
+//	speed   playback speed multiplier (default 1)
+//	idle    maximum idle gap in seconds; longer pauses are shortened (default: no limit)
+//	offset  start position in seconds of the idle-compressed recording (default 0)
+//
+// Output is sent as binary frames and window size changes as
+// {"type":"resize","cols":...,"rows":...}. The client may send
+// {"type":"seek","offset":N} to jump to another position. Recordings hold
+// the unfiltered output, so the output filter of cfg is applied again;
+// clipboard requests are dropped rather than offered for confirmation.
+// Only the user whose session was recorded and the administrators of
+// cfg.Recordings may play a recording; it is not found for anyone else.
+type PlaybackHandler struct {
+	dir string
+	cfg Config
+}
+
+// NewPlaybackHandler serves recordings stored in dir. The origin and CSRF
+// settings of cfg apply as for live sessions.
+func NewPlaybackHandler(dir string, cfg Config) *PlaybackHandler {
+	return &PlaybackHandler{dir: dir, cfg: cfg}
+}
+
+// playbackOptions are the parsed query parameters of a playback request.
+type playbackOptions struct {
+	speed   float64
+	maxIdle float64
+	offset  float64
+}
+
+func parsePlaybackOptions(r *http.Request) (playbackOptions, error) {
+	opts := playbackOptions{speed: 1}
+	query := r.URL.Query()
+	for _, p := range []struct {
+		name string
+		dst  *float64
+	}{
+		{"speed", &opts.speed},
+		{"idle", &opts.maxIdle},
+		{"offset", &opts.offset},
+	} {
+		value := query.Get(p.name)
+		if value == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 {
+			return opts, fmt.Errorf("invalid %s: %q", p.name, value)
+		}
+		*p.dst = f
+	}
+	if opts.speed == 0 {
+		return opts, errors.New("speed must be positive")
+	}
+	return opts, nil
+}
+
+// ServeHTTP validates the request, loads the recording and streams it.
+func (p *PlaybackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !checkRequest(p.cfg, w, r) {
+		return
+	}
+	opts, err := parsePlaybackOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	header, events, err := recording.Load(p.dir, name)
+	if err != nil {
+		switch {
+		case errors.Is(err, recording.ErrInvalidName):
+			http.Error(w, "invalid recording name", http.StatusBadRequest)
+		case errors.Is(err, os.ErrNotExist):
+			http.NotFound(w, r)
+		default:
+			slog.Error("failed to load recording", "name", name, "error", err)
+			http.Error(w, "failed to load recording", http.StatusInternalServerError)
+		}
+		return
+	}
+	var user, realm string
+	if meta := header.Wsconsole; meta != nil {
+		user, realm = meta.User, meta.Realm
+	}
+	if ident := auth.FromContext(r.Context()); !p.cfg.Recordings.Permits(ident, user, realm) {
+		slog.Info("playback refused", "name", name, "remote", r.RemoteAddr, "user", userKey(ident))
+		http.NotFound(w, r)
+		return
+	}
+
+	u := upgrader
+	u.CheckOrigin = p.cfg.Origins.allowed
+	ws, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("failed to upgrade WebSocket", "error", err)
+		return
+	}
+	conn := &wsConn{Conn: ws}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			slog.Warn("failed to close connection", "error", err)
+		}
+	}()
+
+	slog.Info("playback started", "name", name, "remote", r.RemoteAddr, "speed", opts.speed, "offset", opts.offset)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Client messages only carry seek requests
+	seek := make(chan float64)
+	go func() {
+		defer cancel()
+		conn.SetReadLimit(maxMessageSize)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "seek" || msg.Offset < 0 {
+				slog.Debug("ignoring playback message", "data", string(data))
+				continue
+			}
+			select {
+			case seek <- msg.Offset:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Keep the connection alive across long pauses
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.writeMessage(websocket.PingMessage, nil); err != nil {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := conn.writeJSON(Message{Type: "resize", Cols: header.Width, Rows: header.Height}); err != nil {
+		slog.Warn("failed to send initial size", "error", err)
+		return
+	}
+
+	timeline := recording.Retime(events, 1, opts.maxIdle)
+	offset := opts.offset
+	for {
+		next, err := playFrom(ctx, conn, timeline, offset, opts.speed, seek, newOutputFilter(p.cfg))
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("playback error", "name", name, "error", err)
+			}
+			return
+		}
+		if next < 0 {
+			break
+		}
+		offset = next
+	}
+
+	slog.Info("playback finished", "name", name, "remote", r.RemoteAddr)
+	sendCloseMessage(conn, websocket.CloseNormalClosure, "playback finished")
+}
+
+// playFrom renders everything before offset at once, then plays the rest in
+// real time. It returns the new offset when the client seeks, or -1 once
+// the recording has been played to the end. Output passes through filter,
+// which starts afresh with the reset screen.
+func playFrom(ctx context.Context, conn *wsConn, timeline []recording.Event, offset, speed float64, seek <-chan float64, filter *outputFilter) (float64, error) {
+	// Fast-forward: coalesce output up to the offset into as few frames as possible
+	buf := []byte(terminalReset)
+	i := 0
+	for ; i < len(timeline) && timeline[i].Time < offset; i++ {
+		ev := timeline[i]
+		switch ev.Code {
+		case "o":
+			data, _ := filter.filter([]byte(ev.Data))
+			buf = append(buf, data...)
+		case "r":
+			if err := conn.writeMessage(websocket.BinaryMessage, buf); err != nil {
+				return 0, err
+			}
+			buf = buf[:0]
+			if err := sendPlaybackEvent(conn, ev, filter); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(buf) > 0 {
+		if err := conn.writeMessage(websocket.BinaryMessage, buf); err != nil {
+			return 0, err
+		}
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	for ; i < len(timeline); i++ {
+		ev := timeline[i]
+		due := time.Duration((ev.Time - offset) / speed * float64(time.Second))
+		if wait := due - time.Since(start); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case next := <-seek:
+				return next, nil
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+		if err := sendPlaybackEvent(conn, ev, filter); err != nil {
+			return 0, err
+		}
+	}
+	return -1, nil
+}
+
+// sendPlaybackEvent writes one recorded event to the client, with output
+// passed through filter.
+func sendPlaybackEvent(conn *wsConn, ev recording.Event, filter *outputFilter) error {
+	switch ev.Code {
+	case "o":
+		data, _ := filter.filter([]byte(ev.Data))
+		if len(data) == 0 {
+			return nil
+		}
+		return conn.writeMessage(websocket.BinaryMessage, data)
+	case "r":
+		var cols, rows int
+		if _, err := fmt.Sscanf(ev.Data, "%dx%d", &cols, &rows); err != nil {
+			slog.Debug("ignoring malformed resize event", "data", ev.Data)
+			return nil
+		}
+		return conn.writeJSON(Message{Type: "resize", Cols: cols, Rows: rows})
+	}
+	return nil
+}
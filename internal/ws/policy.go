@@ -0,0 +1,121 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/danmaid/wsconsole/internal/auth"
+)
+
+// LauncherPolicy restricts which authenticated identities may start
+// sessions with each launcher strategy. Launchers it does not mention are
+// available to everyone.
+type LauncherPolicy struct {
+	allowed map[string]map[string]bool // launcher -> identity keys, "*" for any
+}
+
+// ParseLauncherPolicy parses a semicolon-separated list of launcher rules:
+//
+//	direct=htpasswd:alice,cert:bob;systemd-run=*
+//
+// allows only the htpasswd user alice and the client certificate bob to use
+// the direct launcher, and any authenticated identity to use systemd-run.
+// Identities are qualified with their realm (see auth.Identity.Key), so
+// that the same name from another authentication method does not match.
+func ParseLauncherPolicy(spec string) (LauncherPolicy, error) {
+	p := LauncherPolicy{allowed: make(map[string]map[string]bool)}
+	for _, rule := range strings.Split(spec, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		launcher, names, ok := strings.Cut(rule, "=")
+		launcher = strings.TrimSpace(launcher)
+		if !ok || launcher == "" {
+			return LauncherPolicy{}, fmt.Errorf("invalid launcher rule %q: want launcher=identity,...", rule)
+		}
+		if p.allowed[launcher] == nil {
+			p.allowed[launcher] = make(map[string]bool)
+		}
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name != "*" && !strings.Contains(name, ":") {
+				return LauncherPolicy{}, fmt.Errorf("invalid identity %q in launcher rule %q: want realm:name, e.g. htpasswd:%s", name, rule, name)
+			}
+			p.allowed[launcher][name] = true
+		}
+	}
+	return p, nil
+}
+
+// userName returns the name of ident, or "" for unauthenticated requests.
+func userName(ident *auth.Identity) string {
+	if ident == nil {
+		return ""
+	}
+	return ident.Name
+}
+
+// userKey returns the realm-qualified key of ident (see auth.Identity.Key),
+// or "" for unauthenticated requests. Ownership and per-user limits are
+// decided on the key, never on the bare name.
+func userKey(ident *auth.Identity) string {
+	if ident == nil {
+		return ""
+	}
+	return ident.Key()
+}
+
+// permits reports whether ident may start a session with launcher.
+// Unauthenticated requests may only use unrestricted launchers.
+func (p LauncherPolicy) permits(launcher string, ident *auth.Identity) bool {
+	names, restricted := p.allowed[launcher]
+	if !restricted {
+		return true
+	}
+	return ident != nil && (names["*"] || names[ident.Key()])
+}
+
+// RecordingPolicy decides who may list and play recordings: the identity
+// whose session was recorded, and the administrators it names. The zero
+// value has no administrators.
+type RecordingPolicy struct {
+	admins map[string]bool // identity keys
+}
+
+// ParseRecordingPolicy parses a comma-separated list of administrators,
+// qualified with their realm like launcher rules, e.g.
+// "htpasswd:alice,oidc:auditor".
+func ParseRecordingPolicy(list string) (RecordingPolicy, error) {
+	p := RecordingPolicy{admins: make(map[string]bool)}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !strings.Contains(name, ":") {
+			return RecordingPolicy{}, fmt.Errorf("invalid identity %q: want realm:name, e.g. htpasswd:%s", name, name)
+		}
+		p.admins[name] = true
+	}
+	return p, nil
+}
+
+// Permits reports whether ident may see the recording of a session started
+// by user in realm. Recordings of unauthenticated sessions are only
+// available to unauthenticated requests, i.e. when authentication is off.
+func (p RecordingPolicy) Permits(ident *auth.Identity, user, realm string) bool {
+	if ident != nil && p.admins[ident.Key()] {
+		return true
+	}
+	if user == "" {
+		return ident == nil
+	}
+	return ident != nil && ident.Name == user && ident.Realm() == realm
+}
@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocols negotiated through the Sec-WebSocket-Protocol header. The
+// version suffix changes whenever a protocol changes incompatibly, so that
+// old clients keep working against new servers and vice versa.
+const (
+	// protocolBinary carries terminal data in binary frames; text frames
+	// are always JSON control messages ("resize", "ack").
+	protocolBinary = "wsconsole.binary.v1"
+	// protocolJSON carries everything as JSON text frames (see Message).
+	protocolJSON = "wsconsole.json.v1"
+	// protocolMux carries several sessions over one connection (see mux.go).
+	protocolMux = "wsconsole.mux.v1"
+
+	// protocolLegacy is used by clients that offer no subprotocol. The
+	// ?mode= query parameter selects JSON or multiplexed mode; otherwise
+	// binary mode treats text frames that are not control messages as input.
+	protocolLegacy = ""
+)
+
+// subprotocols lists the supported subprotocols.
+var subprotocols = []string{protocolBinary, protocolJSON, protocolMux, protocolTTYD, protocolK8s}
+
+var errUnsupportedProtocol = errors.New("unsupported WebSocket subprotocol")
+
+// selectProtocol picks the first supported subprotocol offered by the
+// client. A client that offers none gets the protocol named by the legacy
+// ?mode= query parameter.
+func selectProtocol(r *http.Request) (string, error) {
+	offered := websocket.Subprotocols(r)
+	if len(offered) == 0 {
+		switch r.URL.Query().Get("mode") {
+		case "json":
+			return protocolJSON, nil
+		case "mux":
+			return protocolMux, nil
+		}
+		return protocolLegacy, nil
+	}
+	for _, p := range offered {
+		for _, supported := range subprotocols {
+			if p == supported {
+				return p, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w %s (supported: %s)", errUnsupportedProtocol,
+		strings.Join(offered, ", "), strings.Join(subprotocols, ", "))
+}
@@ -0,0 +1,686 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/danmaid/wsconsole/internal/auth"
+	"github.com/danmaid/wsconsole/internal/pty"
+	"github.com/danmaid/wsconsole/internal/recording"
+	"github.com/danmaid/wsconsole/internal/systemd"
+)
+
+const (
+	// DefaultSessionGrace is how long a detached session waits for a reattach.
+	DefaultSessionGrace = time.Minute
+	// DefaultScrollbackSize is the amount of recent output replayed on reattach.
+	DefaultScrollbackSize = 64 * 1024
+
+	subscriberQueueSize = 64 // buffered output chunks per attached connection
+	eventQueueSize      = 16 // buffered notifications per attached connection
+	inputQueueSize      = 64 // buffered client input messages per session
+)
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errSessionExited   = errors.New("session has exited")
+	errSessionReplaced = errors.New("session attached by another connection")
+	errViewerTooSlow   = errors.New("viewer could not keep up with session output")
+	errReadOnly        = errors.New("read-only viewer")
+	errNotLoggedIn     = errors.New("no user is logged in on the terminal")
+
+	errLauncherNotAllowed = errors.New("launcher not allowed")
+)
+
+// session owns a login process and its PTY master independently of any
+// WebSocket connection, so that a dropped connection can reattach later.
+type session struct {
+	id        string
+	viewID    string // joins the session read-only, see Handler.openSession
+	cmd       *exec.Cmd
+	ptyMaster *os.File
+	cleanup   func() error
+	cancel    context.CancelFunc
+	grace     time.Duration
+	onExit    func(*session)
+	launcher  string
+	login     systemd.LoginLauncher // interprets the login process exit status
+	tty       string                // PTY slave device, e.g. /dev/pts/3
+	remote    string
+	user      string   // name of the authenticated identity that started the session
+	realm     string   // the identity's realm, see auth.Identity.Realm
+	userKey   string   // the identity's realm-qualified key, see userKey
+	groups    []string // the identity's groups, for auditing
+	started   time.Time
+	recorder  *recording.Recorder
+	output    compressionStats // output sent to attached connections
+
+	idleTimeout  time.Duration
+	idleWarning  time.Duration
+	maxLifetime  time.Duration
+	lastActivity atomic.Int64 // unix nanoseconds of the last input or output
+
+	mu         sync.Mutex
+	scrollback *ringBuffer
+	owner      *subscriber
+	viewers    map[*subscriber]struct{}
+	graceTimer *time.Timer
+	exited     bool
+	exit       *exitStatus // set once the login process has been reaped
+	endReason  error       // why the server closed the session, see closeWith
+	osc        oscParser
+	term       terminalState // reported by the shell in OSC sequences
+
+	input chan []byte   // client input waiting to be written to the PTY
+	done  chan struct{} // closed once the login process has been reaped
+}
+
+// subscriber receives PTY output on behalf of one attached connection.
+// A session has at most one owner, which may write input and resize, and
+// any number of read-only viewers.
+type subscriber struct {
+	viewer bool
+	remote string
+	out    chan []byte   // closed by the session when the PTY reaches EOF
+	events chan Message  // session notifications such as viewers joining
+	closed chan struct{} // closed when the subscriber is detached or dropped
+	err    error         // why closed was closed; read only after closed
+}
+
+func newSubscriber(viewer bool, remote string) *subscriber {
+	return &subscriber{
+		viewer: viewer,
+		remote: remote,
+		out:    make(chan []byte, subscriberQueueSize),
+		events: make(chan Message, eventQueueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+// drop closes the subscriber with the given reason (nil for a normal detach).
+func (sub *subscriber) drop(err error) {
+	sub.err = err
+	close(sub.closed)
+}
+
+// notify queues an event without blocking the session.
+func (sub *subscriber) notify(msg Message) {
+	select {
+	case sub.events <- msg:
+	default:
+		slog.Debug("dropped session event", "type", msg.Type, "remote", sub.remote)
+	}
+}
+
+func newSession(id string, cmd *exec.Cmd, ptyMaster *os.File, cleanup func() error, cancel context.CancelFunc, cfg Config) *session {
+	s := &session{
+		id:          id,
+		cmd:         cmd,
+		ptyMaster:   ptyMaster,
+		cleanup:     cleanup,
+		cancel:      cancel,
+		grace:       cfg.SessionGrace,
+		idleTimeout: cfg.IdleTimeout,
+		idleWarning: cfg.IdleWarning,
+		maxLifetime: cfg.MaxLifetime,
+		scrollback:  newRingBuffer(cfg.ScrollbackSize),
+		viewers:     make(map[*subscriber]struct{}),
+		started:     time.Now(),
+		input:       make(chan []byte, inputQueueSize),
+		done:        make(chan struct{}),
+	}
+	s.touch()
+	return s
+}
+
+// run pumps PTY output into the scrollback buffer and the attached
+// subscribers until the PTY closes, then reaps the login process.
+// The owner applies backpressure to the PTY; viewers that fall behind are dropped.
+func (s *session) run() {
+	go s.writeLoop()
+	go s.watchTimeouts(s.idleTimeout, s.idleWarning, s.maxLifetime)
+
+	buf := make([]byte, ptyBufferSize)
+	for {
+		n, err := s.ptyMaster.Read(buf)
+		if n > 0 {
+			s.touch()
+			data := make([]byte, n)
+			copy(data, buf[:n])
+
+			s.mu.Lock()
+			if _, err := s.scrollback.Write(data); err != nil {
+				slog.Warn("failed to write scrollback", "session", s.id, "error", err)
+			}
+			if s.recorder != nil {
+				if err := s.recorder.Output(data); err != nil {
+					slog.Error("failed to record output", "session", s.id, "error", err)
+				}
+			}
+			for _, event := range s.osc.feed(data) {
+				if s.term.apply(event) {
+					s.broadcast(event)
+				}
+			}
+			owner := s.owner
+			for v := range s.viewers {
+				select {
+				case v.out <- data:
+				default:
+					slog.Info("dropping slow viewer", "session", s.id, "remote", v.remote)
+					s.removeViewer(v, errViewerTooSlow)
+				}
+			}
+			s.mu.Unlock()
+
+			if owner != nil {
+				select {
+				case owner.out <- data:
+				case <-owner.closed:
+				}
+			}
+		}
+		if err != nil {
+			// The master returns EIO once the last slave descriptor is closed.
+			if !errors.Is(err, syscall.EIO) && !errors.Is(err, os.ErrClosed) && !errors.Is(err, io.EOF) {
+				slog.Warn("PTY read error", "session", s.id, "error", err)
+			}
+			break
+		}
+	}
+
+	// Reap the process before signalling EOF so the exit status can be reported
+	waitErr := s.cmd.Wait()
+	state := s.cmd.ProcessState
+	exit := newExitStatus(state, s.launcher, systemd.LauncherFailed(s.login, state, time.Since(s.started)))
+	if exit.launcherFailed {
+		slog.Warn("launcher failed", "session", s.id, "launcher", s.launcher, "error", waitErr)
+	} else {
+		slog.Info("login process exited", "session", s.id, "reason", exit.reason(), "error", waitErr)
+	}
+
+	s.mu.Lock()
+	s.exited = true
+	s.exit = exit
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+	}
+	if s.owner != nil {
+		close(s.owner.out)
+	}
+	for v := range s.viewers {
+		close(v.out)
+	}
+	s.mu.Unlock()
+	if err := s.cleanup(); err != nil {
+		slog.Warn("failed to cleanup", "session", s.id, "error", err)
+	}
+	if s.recorder != nil {
+		if err := s.recorder.Close(); err != nil {
+			slog.Warn("failed to close recording", "session", s.id, "error", err)
+		}
+	}
+	s.cancel()
+	close(s.done)
+
+	if s.onExit != nil {
+		s.onExit(s)
+	}
+	slog.Info("session ended", "session", s.id, "user", s.user,
+		"raw_bytes", s.output.raw.Load(), "wire_bytes", s.output.wire.Load())
+}
+
+// stats returns the session's output statistics.
+func (s *session) stats() SessionStats {
+	s.mu.Lock()
+	term := s.term
+	s.mu.Unlock()
+	return SessionStats{
+		Session:   s.id,
+		Remote:    s.remote,
+		User:      s.user,
+		Groups:    s.groups,
+		Launcher:  s.launcher,
+		Started:   s.started,
+		RawBytes:  s.output.raw.Load(),
+		WireBytes: s.output.wire.Load(),
+
+		Title:      term.title,
+		Cwd:        term.cwd,
+		Activity:   term.activity,
+		LastStatus: term.lastStatus,
+	}
+}
+
+// attach makes a new owner subscriber and returns the scrollback to
+// replay. Any previous owner is detached and told it has been replaced.
+func (s *session) attach(remote string) (*subscriber, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.exited {
+		return nil, nil, errSessionExited
+	}
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+		s.graceTimer = nil
+	}
+	if s.owner != nil {
+		s.owner.drop(errSessionReplaced)
+	}
+	sub := newSubscriber(false, remote)
+	s.owner = sub
+	return sub, s.scrollback.Bytes(), nil
+}
+
+// attachViewer adds a read-only subscriber and returns the scrollback to
+// replay. The owner and other viewers are notified of the join.
+func (s *session) attachViewer(remote string) (*subscriber, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.exited {
+		return nil, nil, errSessionExited
+	}
+	sub := newSubscriber(true, remote)
+	s.viewers[sub] = struct{}{}
+	s.broadcast(Message{Type: "join", Remote: remote, Viewers: len(s.viewers)})
+	slog.Info("viewer joined", "session", s.id, "remote", remote, "viewers", len(s.viewers))
+	return sub, s.scrollback.Bytes(), nil
+}
+
+// isOwner reports whether sub currently owns the session.
+func (s *session) isOwner(sub *subscriber) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.owner == sub
+}
+
+// broadcast notifies the owner and all viewers. Callers must hold s.mu.
+func (s *session) broadcast(msg Message) {
+	if s.owner != nil {
+		s.owner.notify(msg)
+	}
+	for v := range s.viewers {
+		v.notify(msg)
+	}
+}
+
+// removeViewer drops a viewer and notifies the rest. Callers must hold s.mu.
+func (s *session) removeViewer(sub *subscriber, err error) {
+	if _, ok := s.viewers[sub]; !ok {
+		return
+	}
+	delete(s.viewers, sub)
+	sub.drop(err)
+	s.broadcast(Message{Type: "leave", Remote: sub.remote, Viewers: len(s.viewers)})
+	slog.Info("viewer left", "session", s.id, "remote", sub.remote, "viewers", len(s.viewers))
+}
+
+// detach releases sub. When the owner leaves, the grace period starts
+// after which the session is terminated; viewers keep watching meanwhile.
+func (s *session) detach(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sub.viewer {
+		s.removeViewer(sub, nil)
+		return
+	}
+	if s.owner != sub {
+		return
+	}
+	s.owner = nil
+	sub.drop(nil)
+	if s.exited {
+		return
+	}
+	if s.grace <= 0 {
+		go s.close()
+		return
+	}
+	slog.Info("session detached", "session", s.id, "grace", s.grace)
+	s.graceTimer = time.AfterFunc(s.grace, func() {
+		slog.Info("session grace period expired", "session", s.id)
+		s.close()
+	})
+}
+
+// exitCode returns the login process exit code once it has been reaped.
+// It is nil while the process is running or if it was killed by a signal.
+func (s *session) exitCode() *int {
+	if exit := s.exitInfo(); exit != nil {
+		return exit.code
+	}
+	return nil
+}
+
+// exitInfo returns how the login process ended, or nil while it is running.
+func (s *session) exitInfo() *exitStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exit
+}
+
+// write sends client input to the PTY.
+// Writes are queued so that a connection's read loop keeps handling
+// control messages (such as flow control acks) while the PTY input buffer
+// is full.
+func (s *session) write(p []byte) error {
+	select {
+	case s.input <- p:
+		s.touch()
+		return nil
+	case <-s.done:
+		return errSessionExited
+	}
+}
+
+// writeLoop drains queued input into the PTY until the session ends.
+func (s *session) writeLoop() {
+	for {
+		select {
+		case p := <-s.input:
+			if _, err := s.ptyMaster.Write(p); err != nil {
+				slog.Warn("PTY write error", "session", s.id, "error", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// resize sets the PTY window size.
+func (s *session) resize(cols, rows int) error {
+	// Hold the lock so the PTY master cannot be closed underneath us
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exited {
+		return errSessionExited
+	}
+	if err := pty.SetWinsize(s.ptyMaster.Fd(), cols, rows); err != nil {
+		return err
+	}
+	if s.recorder != nil {
+		if err := s.recorder.Resize(cols, rows); err != nil {
+			slog.Error("failed to record resize", "session", s.id, "error", err)
+		}
+	}
+	return nil
+}
+
+// startRecording begins an asciicast recording of the session in dir.
+func (s *session) startRecording(dir string) error {
+	cols, rows, err := pty.GetWinsize(s.ptyMaster.Fd())
+	if err != nil {
+		slog.Debug("initial window size unknown", "session", s.id, "error", err)
+	}
+	rec, err := recording.Create(dir, recording.Metadata{
+		Session:  s.id,
+		Remote:   s.remote,
+		User:     s.user,
+		Realm:    s.realm,
+		Groups:   s.groups,
+		Launcher: s.launcher,
+		Start:    s.started,
+	}, cols, rows)
+	if err != nil {
+		return err
+	}
+	s.recorder = rec
+	return nil
+}
+
+// close terminates the login process; run observes the PTY closing and
+// finishes the teardown.
+func (s *session) close() {
+	if s.cmd.Process != nil {
+		slog.Debug("killing process", "session", s.id, "pid", s.cmd.Process.Pid)
+		if err := s.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			slog.Warn("failed to kill process", "session", s.id, "error", err)
+		}
+	}
+	s.cancel()
+}
+
+// registry tracks live sessions by their opaque ID.
+type registry struct {
+	cfg            Config
+	selectLauncher func(systemd.LoginStrategy) (systemd.LoginLauncher, error)
+
+	mu         sync.Mutex
+	sessions   map[string]*session
+	views      map[string]*session // by view ID
+	starting   int                 // sessions reserved but not yet added, see reserve
+	startingBy map[string]int      // the same by user
+}
+
+func newRegistry(cfg Config) *registry {
+	return &registry{
+		cfg:            cfg,
+		selectLauncher: systemd.SelectLauncher,
+		sessions:       make(map[string]*session),
+		views:          make(map[string]*session),
+		startingBy:     make(map[string]int),
+	}
+}
+
+// start launches a new login session with the given launcher strategy.
+// remote is the address of the client that requested it, and ident its
+// authenticated identity, whose constraints the session is started with.
+func (r *registry) start(strategy systemd.LoginStrategy, remote string, ident *auth.Identity) (*session, error) {
+	release, err := r.reserve(userKey(ident))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	viewID, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	launcher, err := r.selectLauncher(strategy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select launcher: %w", err)
+	}
+	if !r.cfg.Launchers.permits(launcher.Name(), ident) {
+		return nil, fmt.Errorf("%w: %s for %q", errLauncherNotAllowed, launcher.Name(), userName(ident))
+	}
+	cfg := r.cfg
+	if ident != nil {
+		if ident.LoginUser != "" {
+			if launcher, err = systemd.LoginAs(launcher, ident.LoginUser); err != nil {
+				return nil, err
+			}
+		}
+		cfg.MaxLifetime = shorterLimit(cfg.MaxLifetime, ident.MaxLifetime)
+		cfg.IdleTimeout = shorterLimit(cfg.IdleTimeout, ident.IdleTimeout)
+	}
+
+	// The session outlives the request that created it, so it gets its own context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd, ptyMaster, cleanup, err := systemd.StartLoginPTY(ctx, launcher)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	s := newSession(id, cmd, ptyMaster, cleanup, cancel, cfg)
+	s.viewID = viewID
+	s.launcher = launcher.Name()
+	s.login = launcher
+	if s.tty, err = pty.SlaveName(ptyMaster.Fd()); err != nil {
+		slog.Debug("failed to get PTY name", "session", id, "error", err)
+	}
+	s.remote = remote
+	s.user = userName(ident)
+	s.userKey = userKey(ident)
+	if ident != nil {
+		s.realm = ident.Realm()
+		s.groups = ident.Groups
+	}
+	if r.cfg.RecordDir != "" {
+		// Sessions must not run unrecorded when recording is configured
+		if err := s.startRecording(r.cfg.RecordDir); err != nil {
+			s.close()
+			if err := cmd.Wait(); err != nil {
+				slog.Debug("login process exited", "session", id, "error", err)
+			}
+			if err := cleanup(); err != nil {
+				slog.Warn("failed to cleanup", "session", id, "error", err)
+			}
+			return nil, err
+		}
+	}
+
+	r.add(s)
+	go s.run()
+	slog.Info("session started", "session", id, "pid", cmd.Process.Pid, "launcher", s.launcher, "tty", s.tty, "user", s.user, "groups", s.groups)
+	return s, nil
+}
+
+// shorterLimit returns the shorter of two limits, where zero means none.
+func shorterLimit(a, b time.Duration) time.Duration {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func (r *registry) add(s *session) {
+	s.onExit = r.remove
+	r.mu.Lock()
+	r.sessions[s.id] = s
+	if s.viewID != "" {
+		r.views[s.viewID] = s
+	}
+	r.mu.Unlock()
+}
+
+func (r *registry) remove(s *session) {
+	r.mu.Lock()
+	if r.sessions[s.id] == s {
+		delete(r.sessions, s.id)
+	}
+	if r.views[s.viewID] == s {
+		delete(r.views, s.viewID)
+	}
+	r.mu.Unlock()
+}
+
+// get looks up a live session by ID.
+func (r *registry) get(id string) (*session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	return s, nil
+}
+
+// getView looks up a live session by its view ID.
+func (r *registry) getView(view string) (*session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.views[view]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	return s, nil
+}
+
+// list returns the live sessions, oldest first.
+func (r *registry) list() []*session {
+	r.mu.Lock()
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].started.Before(sessions[j].started)
+	})
+	return sessions
+}
+
+// closeAll terminates every live session.
+func (r *registry) closeAll() {
+	for _, s := range r.list() {
+		s.close()
+	}
+}
+
+// newSessionID returns a random, URL-safe session identifier.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ringBuffer keeps the most recent bytes written to it.
+type ringBuffer struct {
+	data []byte
+	pos  int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	if size < 0 {
+		size = 0
+	}
+	return &ringBuffer{data: make([]byte, size)}
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	size := len(r.data)
+	if size == 0 {
+		return n, nil
+	}
+	if n >= size {
+		copy(r.data, p[n-size:])
+		r.pos = 0
+		r.full = true
+		return n, nil
+	}
+	c := copy(r.data[r.pos:], p)
+	copy(r.data, p[c:])
+	if r.pos+n >= size {
+		r.full = true
+	}
+	r.pos = (r.pos + n) % size
+	return n, nil
+}
+
+// Bytes returns a copy of the buffered bytes in write order.
+func (r *ringBuffer) Bytes() []byte {
+	if !r.full {
+		return append([]byte(nil), r.data[:r.pos]...)
+	}
+	out := make([]byte, 0, len(r.data))
+	out = append(out, r.data[r.pos:]...)
+	return append(out, r.data[:r.pos]...)
+}
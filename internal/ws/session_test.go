@@ -0,0 +1,372 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	creackpty "github.com/creack/pty"
+)
+
+func TestRingBufferKeepsMostRecentBytes(t *testing.T) {
+	r := newRingBuffer(8)
+
+	if got := r.Bytes(); len(got) != 0 {
+		t.Fatalf("empty buffer returned %q", got)
+	}
+
+	r.Write([]byte("abc"))
+	if got := string(r.Bytes()); got != "abc" {
+		t.Fatalf("got %q, want %q", got, "abc")
+	}
+
+	r.Write([]byte("defgh"))
+	if got := string(r.Bytes()); got != "abcdefgh" {
+		t.Fatalf("got %q, want %q", got, "abcdefgh")
+	}
+
+	r.Write([]byte("ij"))
+	if got := string(r.Bytes()); got != "cdefghij" {
+		t.Fatalf("got %q, want %q", got, "cdefghij")
+	}
+
+	r.Write([]byte("0123456789"))
+	if got := string(r.Bytes()); got != "23456789" {
+		t.Fatalf("got %q, want %q", got, "23456789")
+	}
+}
+
+func TestRingBufferZeroSize(t *testing.T) {
+	r := newRingBuffer(0)
+	if n, err := r.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if got := r.Bytes(); len(got) != 0 {
+		t.Fatalf("got %q, want empty", got)
+	}
+}
+
+func TestOSCParser(t *testing.T) {
+	stream := "\x1b[1mbold\x1b]0;first\x07 \x1b]2;sec" + // title split across reads
+		"ond\x1b\\ \x1b]7;file://host/home/a%20b\x07" + // ST terminator, escaped cwd
+		"\x1b]133;D;2;aid=1\x07" + // command status with extra parameters
+		"\x1b]0;aborted\x1b[0m\x1b]8;;http://x\x07" + // aborted OSC, unknown OSC
+		"\x1b]2;" + strings.Repeat("x", maxOSCSize+1) + "\x07" // too long
+
+	var p oscParser
+	var got []Message
+	for _, chunk := range strings.SplitAfter(stream, "sec") {
+		got = append(got, p.feed([]byte(chunk))...)
+	}
+	want := []Message{
+		{Type: "title", Title: "first"},
+		{Type: "title", Title: "second"},
+		{Type: "cwd", Cwd: "/home/a b"},
+		{Type: "prompt", Mark: "D"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Type != w.Type || g.Title != w.Title || g.Cwd != w.Cwd || g.Mark != w.Mark {
+			t.Errorf("event %d = %+v, want %+v", i, g, w)
+		}
+	}
+	if code := got[3].Code; code == nil || *code != 2 {
+		t.Errorf("prompt status = %v, want 2", code)
+	}
+
+	// Unchanged titles are not reported again, prompts always are
+	var term terminalState
+	if !term.apply(got[0]) || term.apply(got[0]) || !term.apply(got[3]) || !term.apply(got[3]) {
+		t.Error("unexpected apply result")
+	}
+	if term.title != "first" || term.activity != activityPrompt || *term.lastStatus != 2 {
+		t.Errorf("state = %+v", term)
+	}
+}
+
+func TestOutputFilter(t *testing.T) {
+	clip := "\x1b]52;c;aGVsbG8=\x07"
+	tests := []struct {
+		name      string
+		clipboard ClipboardPolicy
+		queries   QueryPolicy
+		in, out   string
+		events    []Message
+	}{
+		{"plain output", ClipboardConfirm, QueriesStrip, "\x1b[1mbold\x1b[0m \x1b]0;t\x07 \xc2\xa3", "\x1b[1mbold\x1b[0m \x1b]0;t\x07 \xc2\xa3", nil},
+		{"allow", ClipboardAllow, QueriesAllow, "a" + clip + "\x1b[21tb", "a" + clip + "\x1b[21tb", nil},
+		{"strip", ClipboardStrip, QueriesAllow, "a" + clip + "b", "ab", nil},
+		{"confirm write", ClipboardConfirm, QueriesAllow, "a" + clip + "b", "ab",
+			[]Message{{Type: "clipboard", Action: "write", Selection: "c", Payload: []byte("hello")}}},
+		{"confirm read with ST", ClipboardConfirm, QueriesAllow, "a\x1b]52;;?\x1b\\b", "ab",
+			[]Message{{Type: "clipboard", Action: "read", Selection: "c"}}},
+		{"C1 introducer", ClipboardConfirm, QueriesAllow, "a\xc2\x9d52;p;?\xc2\x9cb", "ab",
+			[]Message{{Type: "clipboard", Action: "read", Selection: "p"}}},
+		{"aborted", ClipboardConfirm, QueriesAllow, "a\x1b]52;c;aGk=\x1b[0mb", "a\x1b[0mb", nil},
+		{"title report", ClipboardAllow, QueriesStrip, "a\x1b[21tb\x1b[20t\x1b[8;24;80t", "ab\x1b[8;24;80t", nil},
+		{"DECRQSS", ClipboardAllow, QueriesStrip, "a\x1bP$qm\x1b\\b\x1bPq#0\x1b\\", "ab\x1bPq#0\x1b\\", nil},
+		{"overlong", ClipboardConfirm, QueriesAllow, "a\x1b]52;c;" + strings.Repeat("A", maxClipboardSize) + "\x07b", "ab", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Byte by byte and all at once give the same result
+			for _, size := range []int{1, len(tt.in)} {
+				f := newOutputFilter(Config{Clipboard: tt.clipboard, TerminalQueries: tt.queries})
+				var out []byte
+				var events []Message
+				for in := []byte(tt.in); len(in) > 0; {
+					n := min(size, len(in))
+					o, e := f.filter(in[:n])
+					out = append(out, o...)
+					events = append(events, e...)
+					in = in[n:]
+				}
+				if string(out) != tt.out {
+					t.Errorf("chunks of %d: output %q, want %q", size, out, tt.out)
+				}
+				if len(events) != len(tt.events) {
+					t.Fatalf("chunks of %d: events %+v, want %+v", size, events, tt.events)
+				}
+				for i, w := range tt.events {
+					g := events[i]
+					if g.Type != w.Type || g.Action != w.Action || g.Selection != w.Selection || string(g.Payload) != string(w.Payload) {
+						t.Errorf("chunks of %d: event %+v, want %+v", size, g, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOutputFilterExpire(t *testing.T) {
+	f := newOutputFilter(Config{Clipboard: ClipboardConfirm, TerminalQueries: QueriesStrip})
+	if out, _ := f.filter([]byte("a\x1b]5")); string(out) != "a" || !f.pending() {
+		t.Fatalf("output %q, pending %v; want the OSC start held", out, f.pending())
+	}
+	// Dropped rather than released, which could complete an OSC 52
+	f.expire()
+	if out, _ := f.filter([]byte("2;c;aGk=\x07b")); string(out) != "2;c;aGk=\x07b" || f.pending() {
+		t.Fatalf("output %q after expiry", out)
+	}
+
+	// Strings being removed are not pending
+	f.filter([]byte("\x1b]52;c;"))
+	if f.pending() {
+		t.Fatal("OSC 52 string reported pending")
+	}
+}
+
+// startTestSession runs /bin/cat on a PTY in place of a login process.
+func startTestSession(t *testing.T, cfg Config) *session {
+	t.Helper()
+	cmd := exec.Command("cat")
+	master, err := creackpty.Start(cmd)
+	if err != nil {
+		t.Skipf("cannot start PTY: %v", err)
+	}
+	_, cancel := context.WithCancel(context.Background())
+	s := newSession("test", cmd, master, master.Close, cancel, cfg)
+	go s.run()
+	t.Cleanup(func() {
+		s.close()
+		<-s.done
+	})
+	return s
+}
+
+// readUntil collects subscriber output until it contains want.
+func readUntil(t *testing.T, sub *subscriber, want []byte) []byte {
+	t.Helper()
+	var got []byte
+	timeout := time.After(5 * time.Second)
+	for !bytes.Contains(got, want) {
+		select {
+		case data, ok := <-sub.out:
+			if !ok {
+				t.Fatalf("output closed before %q, got %q", want, got)
+			}
+			got = append(got, data...)
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q, got %q", want, got)
+		}
+	}
+	return got
+}
+
+func TestSessionReattachReplaysScrollback(t *testing.T) {
+	s := startTestSession(t, Config{SessionGrace: time.Minute, ScrollbackSize: 1024})
+
+	first, _, err := s.attach("test")
+	if err != nil {
+		t.Fatalf("attach() error = %v", err)
+	}
+	if err := s.write([]byte("hello\n")); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	readUntil(t, first, []byte("hello"))
+	s.detach(first)
+
+	select {
+	case <-s.done:
+		t.Fatal("session ended during grace period")
+	default:
+	}
+
+	second, scrollback, err := s.attach("test")
+	if err != nil {
+		t.Fatalf("reattach error = %v", err)
+	}
+	if !bytes.Contains(scrollback, []byte("hello")) {
+		t.Fatalf("scrollback %q does not contain replayed output", scrollback)
+	}
+	if err := s.write([]byte("again\n")); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	readUntil(t, second, []byte("again"))
+}
+
+func TestSessionAttachReplacesOwner(t *testing.T) {
+	s := startTestSession(t, Config{SessionGrace: time.Minute})
+
+	first, _, err := s.attach("test")
+	if err != nil {
+		t.Fatalf("attach() error = %v", err)
+	}
+	if _, _, err := s.attach("test"); err != nil {
+		t.Fatalf("second attach() error = %v", err)
+	}
+
+	select {
+	case <-first.closed:
+	default:
+		t.Fatal("previous owner was not detached")
+	}
+}
+
+func TestSessionGraceExpiry(t *testing.T) {
+	s := startTestSession(t, Config{SessionGrace: 50 * time.Millisecond})
+
+	sub, _, err := s.attach("test")
+	if err != nil {
+		t.Fatalf("attach() error = %v", err)
+	}
+	s.detach(sub)
+
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not terminated after the grace period")
+	}
+	if _, _, err := s.attach("test"); err != errSessionExited {
+		t.Fatalf("attach() after exit error = %v, want %v", err, errSessionExited)
+	}
+}
+
+func TestSessionViewerReceivesOutputAndNotifiesOwner(t *testing.T) {
+	s := startTestSession(t, Config{SessionGrace: time.Minute, ScrollbackSize: 1024})
+
+	owner, _, err := s.attach("owner")
+	if err != nil {
+		t.Fatalf("attach() error = %v", err)
+	}
+	viewer, _, err := s.attachViewer("viewer")
+	if err != nil {
+		t.Fatalf("attachViewer() error = %v", err)
+	}
+
+	select {
+	case msg := <-owner.events:
+		if msg.Type != "join" || msg.Remote != "viewer" || msg.Viewers != 1 {
+			t.Fatalf("owner event = %+v, want join from viewer", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("owner was not notified of the viewer")
+	}
+	if s.isOwner(viewer) {
+		t.Fatal("viewer reported as owner")
+	}
+
+	if err := s.write([]byte("shared\n")); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	readUntil(t, owner, []byte("shared"))
+	readUntil(t, viewer, []byte("shared"))
+
+	s.detach(viewer)
+	select {
+	case msg := <-owner.events:
+		if msg.Type != "leave" || msg.Viewers != 0 {
+			t.Fatalf("owner event = %+v, want leave", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("owner was not notified of the viewer leaving")
+	}
+}
+
+func TestSessionIdleTimeoutWarnsThenCloses(t *testing.T) {
+	s := startTestSession(t, Config{IdleTimeout: 400 * time.Millisecond, IdleWarning: 200 * time.Millisecond})
+	sub, _, err := s.attach("test")
+	if err != nil {
+		t.Fatalf("attach() error = %v", err)
+	}
+
+	// Activity postpones the timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(150 * time.Millisecond)
+		if err := s.write([]byte("x\n")); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+	select {
+	case <-s.done:
+		t.Fatal("active session was closed")
+	default:
+	}
+
+	select {
+	case msg := <-sub.events:
+		if msg.Type != "warning" || msg.Reason != errIdleTimeout.Error() || msg.Seconds <= 0 {
+			t.Fatalf("unexpected event %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no idle warning")
+	}
+	select {
+	case <-s.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle session was not closed")
+	}
+	if got := s.closedBy(); got != errIdleTimeout {
+		t.Fatalf("closedBy() = %v, want %v", got, errIdleTimeout)
+	}
+}
+
+func TestSessionMaxLifetime(t *testing.T) {
+	s := startTestSession(t, Config{MaxLifetime: 300 * time.Millisecond})
+	// Constant activity does not extend the lifetime
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case <-s.done:
+			if got := s.closedBy(); got != errLifetimeExceeded {
+				t.Fatalf("closedBy() = %v, want %v", got, errLifetimeExceeded)
+			}
+			return
+		case <-deadline:
+			t.Fatal("session outlived its maximum lifetime")
+		case <-time.After(50 * time.Millisecond):
+			if err := s.write([]byte("x\n")); err != nil && err != errSessionExited {
+				t.Fatalf("write() error = %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/danmaid/wsconsole/internal/pty"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultSignals are the signals clients may send unless configured
+// otherwise.
+const DefaultSignals = "INT,TERM,HUP,KILL"
+
+// Targets of a "signal" message.
+const (
+	signalForeground = "foreground" // the PTY's foreground process group (default)
+	signalSession    = "session"    // every process in the user's login session
+)
+
+// signalNames are the signals that can be allowed, by name without "SIG".
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+var errSignalNotAllowed = errors.New("signal not allowed")
+
+// SignalPolicy lists the signals clients may send with "signal" messages.
+// The zero value allows none.
+type SignalPolicy struct {
+	allowed map[string]syscall.Signal
+}
+
+// ParseSignalPolicy parses a comma-separated list of signal names such as
+// "INT,TERM" or "SIGINT,SIGTERM". An empty list allows no signals.
+func ParseSignalPolicy(list string) (SignalPolicy, error) {
+	p := SignalPolicy{allowed: make(map[string]syscall.Signal)}
+	for _, name := range strings.Split(list, ",") {
+		name = signalName(name)
+		if name == "" {
+			continue
+		}
+		sig, ok := signalNames[name]
+		if !ok {
+			return SignalPolicy{}, fmt.Errorf("unknown signal %q", name)
+		}
+		p.allowed[name] = sig
+	}
+	return p, nil
+}
+
+func mustParseSignalPolicy(list string) SignalPolicy {
+	p, err := ParseSignalPolicy(list)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// signalName normalizes " sigint " to "INT".
+func signalName(name string) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+}
+
+// empty reports whether the policy allows no signals.
+func (p SignalPolicy) empty() bool {
+	return len(p.allowed) == 0
+}
+
+// lookup returns the named signal if the policy allows it.
+func (p SignalPolicy) lookup(name string) (syscall.Signal, error) {
+	sig, ok := p.allowed[signalName(name)]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", errSignalNotAllowed, name)
+	}
+	return sig, nil
+}
+
+// handleSignal delivers the signal requested by a "signal" message from
+// sub, returning an error to report to the client.
+func handleSignal(sess *session, sub *subscriber, msg Message, policy SignalPolicy) error {
+	if !sess.isOwner(sub) {
+		return fmt.Errorf("signal ignored: %w", errReadOnly)
+	}
+	sig, err := policy.lookup(msg.Signal)
+	if err != nil {
+		return err
+	}
+	if err := sess.signal(sig, msg.Target); err != nil {
+		slog.Warn("failed to send signal", "session", sess.id, "signal", msg.Signal, "target", msg.Target, "error", err)
+		return fmt.Errorf("failed to send signal: %w", err)
+	}
+	slog.Info("signal sent", "session", sess.id, "signal", signalName(msg.Signal), "target", msg.Target, "remote", sub.remote)
+	return nil
+}
+
+// signal sends sig to the foreground process group of the session's
+// terminal, or to every process in the user's login session. Signals are
+// refused until a user is logged in, so they never reach the launcher:
+// systemd-run in particular would end the whole session on INT or TERM.
+func (s *session) signal(sig syscall.Signal, target string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exited {
+		return errSessionExited
+	}
+	if target != "" && target != signalForeground && target != signalSession {
+		return fmt.Errorf("unknown signal target %q", target)
+	}
+	sid, err := s.loginSession()
+	if err != nil {
+		return err
+	}
+	if target == signalSession {
+		return killSession(sid, sig)
+	}
+	pgrp, err := pty.ForegroundProcessGroup(s.ptyMaster.Fd())
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(-pgrp, sig)
+}
+
+// loginSession returns the ID of the user's login session on the terminal.
+// The launched process (login, or systemd-run) leads the terminal's session
+// until login starts the user's shell in a session of its own, so any
+// other session is the user's. systemd-run runs login on a PTY of its own,
+// so its sessions never have one. Callers must hold s.mu.
+func (s *session) loginSession() (int, error) {
+	sid, err := pty.SessionID(s.ptyMaster.Fd())
+	if err != nil {
+		return 0, err
+	}
+	if sid == s.cmd.Process.Pid {
+		return 0, errNotLoggedIn
+	}
+	return sid, nil
+}
+
+// killSession sends sig to every process whose session ID is sid.
+func killSession(sid int, sig syscall.Signal) error {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return fmt.Errorf("failed to list processes: %w", err)
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if s, err := unix.Getsid(pid); err == nil && s == sid {
+			if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"time"
+)
+
+const (
+	// DefaultIdleTimeout closes sessions without input or output for this long.
+	DefaultIdleTimeout = 5 * time.Minute
+	// DefaultIdleWarning is how long before the timeout clients are warned.
+	DefaultIdleWarning = 30 * time.Second
+)
+
+// Reasons a session was closed by the server rather than ended by its
+// login process. The texts double as close reasons sent to clients.
+var (
+	errIdleTimeout      = errors.New("idle timeout")
+	errLifetimeExceeded = errors.New("lifetime exceeded")
+)
+
+// touch records input or output activity.
+func (s *session) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// watchTimeouts closes the session once it has had no input or output for
+// idle, or has existed for lifetime; zero disables either limit. Attached
+// clients receive {"type":"warning","reason":...,"seconds":N} warning
+// before the deadline. Activity after an idle warning postpones the timeout,
+// and a new warning is sent before the new deadline.
+func (s *session) watchTimeouts(idle, warning, lifetime time.Duration) {
+	if idle <= 0 && lifetime <= 0 {
+		return
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var warned time.Time // deadline the last warning was sent for
+	for {
+		select {
+		case <-timer.C:
+		case <-s.done:
+			return
+		}
+
+		now := time.Now()
+		deadline, reason := time.Time{}, error(nil)
+		if idle > 0 {
+			deadline, reason = time.Unix(0, s.lastActivity.Load()).Add(idle), errIdleTimeout
+		}
+		if end := s.started.Add(lifetime); lifetime > 0 && (deadline.IsZero() || end.Before(deadline)) {
+			deadline, reason = end, errLifetimeExceeded
+		}
+
+		if !now.Before(deadline) {
+			slog.Info("closing session", "session", s.id, "reason", reason)
+			s.closeWith(reason)
+			return
+		}
+		next := deadline
+		if warnAt := deadline.Add(-warning); warning > 0 && !deadline.Equal(warned) {
+			if now.Before(warnAt) {
+				next = warnAt
+			} else {
+				warned = deadline
+				seconds := int(math.Ceil(deadline.Sub(now).Seconds()))
+				s.mu.Lock()
+				s.broadcast(Message{Type: "warning", Reason: reason.Error(), Seconds: seconds})
+				s.mu.Unlock()
+			}
+		}
+		timer.Reset(next.Sub(now))
+	}
+}
+
+// closeWith terminates the session, recording why for the clients.
+func (s *session) closeWith(reason error) {
+	s.mu.Lock()
+	if s.endReason == nil {
+		s.endReason = reason
+	}
+	s.mu.Unlock()
+	s.close()
+}
+
+// closedBy returns why the server closed the session, or nil if the login
+// process ended by itself.
+func (s *session) closedBy() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.endReason
+}
@@ -0,0 +1,534 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// File transfer in JSON mode moves files between the client and the
+// machine as the user logged in on the session's terminal:
+//
+//	client -> server: {"type":"upload","transfer":"t1","name":"notes.txt","size":5,"sha256":"<hex>"}
+//	                  {"type":"file-data","transfer":"t1","payload":"<base64>"} (until size bytes)
+//	                  {"type":"download","transfer":"t2","name":"/var/log/app.log"}
+//	                  {"type":"cancel","transfer":"t2"}
+//	server -> client: {"type":"progress","transfer":"t2","bytes":0,"size":1048576}
+//	                  {"type":"file-data","transfer":"t2","payload":"<base64>"} (downloads)
+//	                  {"type":"transferred","transfer":"t1","bytes":5,"sha256":"<hex>"}
+//	                  {"type":"error","transfer":"t1","message":"..."}
+//
+// Relative names are resolved from the shell's working directory. Uploads
+// never replace existing files, and are removed again if the checksum does
+// not match. Downloaded bytes count against the flow control window like
+// terminal output. The file is read or written by a /bin/sh helper running
+// with the credentials of the user's shell, so the user cannot reach
+// anything they could not reach from the terminal. Transfers start only
+// once login has started the shell, and never as root unless root logged in.
+
+// DefaultMaxTransferSize is the default size limit of an uploaded or
+// downloaded file.
+const DefaultMaxTransferSize = 100 << 20
+
+const (
+	transferChunkSize     = 48 * 1024 // file bytes per "file-data" message
+	transferProgressBytes = 1 << 20   // how often "progress" is reported
+	maxTransfers          = 4         // concurrent transfers per connection
+)
+
+// Helper scripts; the file name is passed as $1.
+const (
+	uploadScript   = `set -C && exec cat > "$1"` // -C: fail rather than overwrite
+	downloadScript = `stat -L -c %s -- "$1" && exec cat -- "$1"`
+	removeScript   = `exec rm -f -- "$1"`
+)
+
+var (
+	errTransfersOff     = errors.New("file transfer is disabled")
+	errUnknownTransfer  = errors.New("unknown transfer")
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errRootTransfer     = errors.New("file transfer as root requires root to log in")
+)
+
+// loginUser is the user whose shell runs on a session's terminal.
+type loginUser struct {
+	cred *syscall.Credential
+	dir  string // the shell's working directory
+}
+
+// loginUser returns the user logged in on the session's terminal, whose
+// shell leads the login session (see loginSession). Until login has
+// started the shell the session leader is login's own child, which may
+// still run as root, so nobody counts as logged in. A shell running as
+// root is accepted only if root is who logged in, as recorded in the
+// audit login UID that pam_loginuid sets.
+func (s *session) loginUser() (*loginUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exited {
+		return nil, errSessionExited
+	}
+	sid, err := s.loginSession()
+	if err != nil {
+		return nil, err
+	}
+	launcher, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", s.cmd.Process.Pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get launcher executable: %w", err)
+	}
+	leader, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", sid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shell executable: %w", err)
+	}
+	if leader == launcher {
+		return nil, errNotLoggedIn
+	}
+	cred, err := processCredential(sid)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Uid == 0 {
+		if uid, err := loginUID(sid); err != nil || uid != 0 {
+			return nil, errRootTransfer
+		}
+	}
+	dir, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", sid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get working directory: %w", err)
+	}
+	return &loginUser{cred: cred, dir: dir}, nil
+}
+
+// processCredential reads the real user, group and supplementary groups of
+// a process from /proc.
+func processCredential(pid int) (*syscall.Credential, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read process status: %w", err)
+	}
+	cred := &syscall.Credential{}
+	var haveUid, haveGid bool
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		fields := strings.Fields(value)
+		switch key {
+		case "Uid", "Gid":
+			if len(fields) == 0 {
+				continue
+			}
+			id, err := strconv.ParseUint(fields[0], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("malformed %s in process status: %w", key, err)
+			}
+			if key == "Uid" {
+				cred.Uid, haveUid = uint32(id), true
+			} else {
+				cred.Gid, haveGid = uint32(id), true
+			}
+		case "Groups":
+			for _, f := range fields {
+				id, err := strconv.ParseUint(f, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("malformed Groups in process status: %w", err)
+				}
+				cred.Groups = append(cred.Groups, uint32(id))
+			}
+		}
+	}
+	if !haveUid || !haveGid {
+		return nil, fmt.Errorf("no credentials in status of process %d", pid)
+	}
+	return cred, nil
+}
+
+// loginUID reads the audit login UID of a process, which is unset
+// (4294967295) unless PAM assigned one at login.
+func loginUID(pid int) (uint32, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/loginuid", pid))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read login UID: %w", err)
+	}
+	uid, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("malformed login UID: %w", err)
+	}
+	return uint32(uid), nil
+}
+
+// command returns a helper running script as the user in their working
+// directory.
+func (u *loginUser) command(ctx context.Context, script, name string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", script, "sh", name)
+	cmd.Dir = u.dir
+	cmd.Env = []string{"PATH=/usr/bin:/bin", "LC_ALL=C"}
+	if int(u.cred.Uid) != os.Getuid() || int(u.cred.Gid) != os.Getgid() {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: u.cred}
+	}
+	return cmd
+}
+
+// helperError describes a failed helper by its error output, such as
+// "Permission denied", rather than its exit status.
+func helperError(err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		if i := strings.LastIndex(msg, "\n"); i >= 0 {
+			msg = msg[i+1:]
+		}
+		return errors.New(msg)
+	}
+	return err
+}
+
+// transfers runs the file transfers of one JSON mode connection.
+type transfers struct {
+	conn *wsConn
+	sess *session
+	sub  *subscriber
+	flow *flowControl // shared with the terminal output; nil is unlimited
+	max  int64        // size limit; zero disables file transfer
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	active map[string]*transfer
+}
+
+// transfer is one upload or download in progress.
+type transfer struct {
+	id       string
+	name     string
+	size     int64
+	want     string // expected checksum of an upload
+	sum      hash.Hash
+	bytes    int64
+	reported int64 // bytes at the last "progress" message
+
+	user   *loginUser
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser // uploads only
+	stderr bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func newTransfers(conn *wsConn, sess *session, sub *subscriber, flow *flowControl, max int64) *transfers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &transfers{conn: conn, sess: sess, sub: sub, flow: flow, max: max, ctx: ctx, cancel: cancel, active: make(map[string]*transfer)}
+}
+
+// close aborts the transfers still in progress when the connection ends.
+func (t *transfers) close() {
+	t.mu.Lock()
+	uploads := make([]*transfer, 0, len(t.active))
+	for _, tr := range t.active {
+		if tr.stdin != nil {
+			uploads = append(uploads, tr)
+		}
+	}
+	t.active = make(map[string]*transfer)
+	t.mu.Unlock()
+	for _, tr := range uploads {
+		t.abortUpload(tr)
+	}
+	t.cancel()
+	t.wg.Wait()
+}
+
+// handle applies an "upload", "file-data", "download" or "cancel" message,
+// returning an error to report for the transfer.
+func (t *transfers) handle(msg Message) error {
+	switch msg.Type {
+	case "upload":
+		return t.upload(msg)
+	case "file-data":
+		return t.data(msg)
+	case "download":
+		return t.download(msg)
+	case "cancel":
+		tr := t.remove(msg.Transfer)
+		if tr == nil {
+			return errUnknownTransfer
+		}
+		if tr.stdin != nil {
+			t.abortUpload(tr)
+		} else {
+			tr.cancel()
+		}
+		slog.Info("file transfer cancelled", "session", t.sess.id, "transfer", tr.id, "name", tr.name)
+	}
+	return nil
+}
+
+// begin checks that a new transfer may start and returns the user it runs as.
+func (t *transfers) begin(msg Message) (*loginUser, error) {
+	if t.max <= 0 {
+		return nil, errTransfersOff
+	}
+	if !t.sess.isOwner(t.sub) {
+		return nil, errReadOnly
+	}
+	if msg.Transfer == "" || msg.Name == "" {
+		return nil, errors.New("transfer and name are required")
+	}
+	t.mu.Lock()
+	_, busy := t.active[msg.Transfer]
+	n := len(t.active)
+	t.mu.Unlock()
+	if busy {
+		return nil, errors.New("transfer is already in progress")
+	}
+	if n >= maxTransfers {
+		return nil, fmt.Errorf("at most %d transfers at a time", maxTransfers)
+	}
+	return t.sess.loginUser()
+}
+
+func (t *transfers) upload(msg Message) error {
+	user, err := t.begin(msg)
+	if err != nil {
+		return err
+	}
+	if msg.Size < 0 || msg.Size > t.max {
+		return fmt.Errorf("file size must be at most %d bytes", t.max)
+	}
+	want := strings.ToLower(msg.SHA256)
+	if sum, err := hex.DecodeString(want); err != nil || len(sum) != sha256.Size {
+		return errors.New("sha256 of the file is required")
+	}
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	tr := &transfer{id: msg.Transfer, name: msg.Name, size: msg.Size, want: want, sum: sha256.New(), user: user, cancel: cancel}
+	tr.cmd = user.command(ctx, uploadScript, msg.Name)
+	tr.cmd.Stderr = &tr.stderr
+	if tr.stdin, err = tr.cmd.StdinPipe(); err != nil {
+		cancel()
+		return err
+	}
+	if err := tr.cmd.Start(); err != nil {
+		cancel()
+		return fmt.Errorf("failed to start upload: %w", err)
+	}
+	t.mu.Lock()
+	t.active[tr.id] = tr
+	t.mu.Unlock()
+	slog.Info("file upload started", "session", t.sess.id, "transfer", tr.id, "name", tr.name, "size", tr.size, "uid", user.cred.Uid)
+	t.progress(tr)
+	if tr.size == 0 {
+		return t.finishUpload(tr)
+	}
+	return nil
+}
+
+// data writes a chunk of an upload.
+func (t *transfers) data(msg Message) error {
+	t.mu.Lock()
+	tr := t.active[msg.Transfer]
+	t.mu.Unlock()
+	if tr == nil || tr.stdin == nil {
+		return errUnknownTransfer
+	}
+	if tr.bytes+int64(len(msg.Payload)) > tr.size {
+		t.remove(tr.id)
+		t.abortUpload(tr)
+		return fmt.Errorf("more than the announced %d bytes", tr.size)
+	}
+	if _, err := tr.stdin.Write(msg.Payload); err != nil {
+		// The helper has failed, e.g. the file exists or is not writable
+		t.remove(tr.id)
+		tr.stdin.Close()
+		err = helperError(tr.cmd.Wait(), &tr.stderr)
+		tr.cancel()
+		return err
+	}
+	tr.sum.Write(msg.Payload)
+	tr.bytes += int64(len(msg.Payload))
+	if tr.bytes == tr.size {
+		return t.finishUpload(tr)
+	}
+	if tr.bytes-tr.reported >= transferProgressBytes {
+		t.progress(tr)
+	}
+	return nil
+}
+
+// finishUpload waits for the helper to write the last bytes and checks
+// the checksum.
+func (t *transfers) finishUpload(tr *transfer) error {
+	t.remove(tr.id)
+	defer tr.cancel()
+	tr.stdin.Close()
+	if err := tr.cmd.Wait(); err != nil {
+		return helperError(err, &tr.stderr)
+	}
+	sum := hex.EncodeToString(tr.sum.Sum(nil))
+	if sum != tr.want {
+		t.removeFile(tr)
+		return errChecksumMismatch
+	}
+	slog.Info("file uploaded", "session", t.sess.id, "transfer", tr.id, "name", tr.name, "bytes", tr.bytes)
+	t.send(Message{Type: "transferred", Transfer: tr.id, Bytes: tr.bytes, SHA256: sum})
+	return nil
+}
+
+// abortUpload stops an upload and removes the partial file. The helper is
+// left to finish rather than killed: only once it has succeeded is it
+// certain that the file is the one it created, not one that already existed.
+func (t *transfers) abortUpload(tr *transfer) {
+	defer tr.cancel()
+	tr.stdin.Close()
+	if err := tr.cmd.Wait(); err == nil {
+		t.removeFile(tr)
+	}
+}
+
+// removeFile deletes a failed upload as the user.
+func (t *transfers) removeFile(tr *transfer) {
+	cmd := tr.user.command(context.Background(), removeScript, tr.name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		slog.Warn("failed to remove incomplete upload", "session", t.sess.id, "name", tr.name, "error", err, "output", string(out))
+	}
+}
+
+func (t *transfers) download(msg Message) error {
+	user, err := t.begin(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(t.ctx)
+	tr := &transfer{id: msg.Transfer, name: msg.Name, sum: sha256.New(), user: user, cancel: cancel}
+	tr.cmd = user.command(ctx, downloadScript, msg.Name)
+	tr.cmd.Stderr = &tr.stderr
+	stdout, err := tr.cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return err
+	}
+	if err := tr.cmd.Start(); err != nil {
+		cancel()
+		return fmt.Errorf("failed to start download: %w", err)
+	}
+	t.mu.Lock()
+	t.active[tr.id] = tr
+	t.mu.Unlock()
+	slog.Info("file download started", "session", t.sess.id, "transfer", tr.id, "name", tr.name, "uid", user.cred.Uid)
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer cancel()
+		err := t.sendFile(ctx, tr, bufio.NewReaderSize(stdout, transferChunkSize))
+		if err != nil {
+			// Stop the helper and let it exit before reporting its error
+			cancel()
+			io.Copy(io.Discard, stdout)
+		}
+		if waitErr := tr.cmd.Wait(); waitErr != nil && (err == nil || tr.stderr.Len() > 0) {
+			// Prefer what the helper said, e.g. that cat could not read the file
+			err = helperError(waitErr, &tr.stderr)
+		}
+		if t.remove(tr.id) == nil {
+			// Cancelled by the client or the connection went away
+			return
+		}
+		if err != nil {
+			slog.Info("file download failed", "session", t.sess.id, "transfer", tr.id, "name", tr.name, "error", err)
+			t.send(Message{Type: "error", Transfer: tr.id, Message: err.Error()})
+			return
+		}
+		slog.Info("file downloaded", "session", t.sess.id, "transfer", tr.id, "name", tr.name, "bytes", tr.bytes)
+		t.send(Message{Type: "transferred", Transfer: tr.id, Bytes: tr.bytes, SHA256: hex.EncodeToString(tr.sum.Sum(nil))})
+	}()
+	return nil
+}
+
+// sendFile streams the helper's output, the file size on a line of its own
+// followed by the file, to the client, as the flow control window allows.
+func (t *transfers) sendFile(ctx context.Context, tr *transfer, out *bufio.Reader) error {
+	line, err := out.ReadString('\n')
+	if err != nil {
+		return nil // the helper failed; its error output says why
+	}
+	if tr.size, err = strconv.ParseInt(strings.TrimSpace(line), 10, 64); err != nil {
+		return fmt.Errorf("unexpected file size %q", line)
+	}
+	if tr.size > t.max {
+		return fmt.Errorf("file is larger than %d bytes", t.max)
+	}
+	t.progress(tr)
+
+	buf := make([]byte, transferChunkSize)
+	for {
+		if err := t.flow.wait(ctx); err != nil {
+			return err
+		}
+		chunk := buf
+		if credit := t.flow.available(); credit < int64(len(chunk)) {
+			chunk = buf[:credit]
+		}
+		n, err := io.ReadFull(out, chunk)
+		if n > 0 {
+			if tr.bytes+int64(n) > t.max {
+				return fmt.Errorf("file is larger than %d bytes", t.max)
+			}
+			tr.sum.Write(buf[:n])
+			tr.bytes += int64(n)
+			if err := t.conn.writeJSON(Message{Type: "file-data", Transfer: tr.id, Payload: buf[:n]}); err != nil {
+				return err
+			}
+			t.flow.sent(n)
+			if tr.bytes-tr.reported >= transferProgressBytes {
+				t.progress(tr)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if tr.bytes != tr.size {
+		return fmt.Errorf("file changed during download (%d of %d bytes)", tr.bytes, tr.size)
+	}
+	if tr.reported != tr.bytes {
+		t.progress(tr)
+	}
+	return nil
+}
+
+// remove forgets a transfer, returning nil if it was not active.
+func (t *transfers) remove(id string) *transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr := t.active[id]
+	delete(t.active, id)
+	return tr
+}
+
+func (t *transfers) progress(tr *transfer) {
+	tr.reported = tr.bytes
+	t.send(Message{Type: "progress", Transfer: tr.id, Bytes: tr.bytes, Size: tr.size})
+}
+
+func (t *transfers) send(msg Message) {
+	if err := t.conn.writeJSON(msg); err != nil {
+		slog.Warn("failed to send transfer message", "type", msg.Type, "error", err)
+	}
+}
@@ -0,0 +1,230 @@
+//go:build linux
+// +build linux
+
+package ws
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocolTTYD is the subprotocol spoken by ttyd clients.
+//
+// Every message is a binary frame starting with a one-byte command. The
+// client first sends a JSON handshake {"AuthToken":"...","columns":N,"rows":N}
+// and then:
+//
+//	'0' + data               terminal input
+//	'1' + {"columns":N,"rows":N}  resize
+//	'2'                      pause output
+//	'3'                      resume output
+//
+// The server replies with:
+//
+//	'0' + data               terminal output
+//	'1' + title              window title
+//	'2' + JSON               client preferences
+//
+// The login session is started once the handshake has been received, so the
+// PTY starts with the client's window size.
+const protocolTTYD = "tty"
+
+// ttyd client commands.
+const (
+	ttydInput     = '0'
+	ttydResize    = '1'
+	ttydPause     = '2'
+	ttydResume    = '3'
+	ttydHandshake = '{'
+)
+
+// ttyd server commands.
+const (
+	ttydOutput         = '0'
+	ttydSetTitle       = '1'
+	ttydSetPreferences = '2'
+)
+
+// ttydInit is the handshake message, also used by the resize command.
+type ttydInit struct {
+	AuthToken string `json:"AuthToken,omitempty"`
+	Columns   int    `json:"columns"`
+	Rows      int    `json:"rows"`
+}
+
+// ttydToken is the AuthToken clients must present when a credential is
+// configured: the base64 encoded "user:password", as ttyd uses.
+func ttydToken(credential string) string {
+	if credential == "" {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(credential))
+}
+
+// ServeTTYDToken serves the token endpoint ttyd clients query before
+// connecting. When a credential is configured the request must carry the
+// same user and password as HTTP Basic authentication.
+func (h *Handler) ServeTTYDToken(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.TTYDCredential != "" {
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user+":"+password), []byte(h.cfg.TTYDCredential)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="wsconsole"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"token": ttydToken(h.cfg.TTYDCredential)}); err != nil {
+		slog.Warn("failed to write token response", "error", err)
+	}
+}
+
+// serveTTYD bridges a ttyd client to a login session.
+func (h *Handler) serveTTYD(ctx context.Context, cancel context.CancelFunc, conn *wsConn, r *http.Request) {
+	conn.SetReadLimit(maxMessageSize)
+	init, err := readTTYDHandshake(conn)
+	if err != nil {
+		slog.Info("ttyd handshake failed", "remote", r.RemoteAddr, "error", err)
+		sendCloseMessage(conn, websocket.ClosePolicyViolation, "invalid handshake")
+		return
+	}
+	if want := ttydToken(h.cfg.TTYDCredential); subtle.ConstantTimeCompare([]byte(init.AuthToken), []byte(want)) != 1 {
+		slog.Info("ttyd authentication failed", "remote", r.RemoteAddr)
+		sendCloseMessage(conn, websocket.ClosePolicyViolation, "authentication failed")
+		return
+	}
+
+	sess, sub, scrollback, resumed, ok := h.attachRequest(conn, r, protocolTTYD)
+	if !ok {
+		return
+	}
+	defer sess.detach(sub)
+
+	if init.Columns > 0 && init.Rows > 0 && sess.isOwner(sub) {
+		if err := sess.resize(init.Columns, init.Rows); err != nil {
+			slog.Warn("failed to resize PTY", "error", err)
+		}
+	}
+
+	title := "login"
+	if hostname, err := os.Hostname(); err == nil {
+		title += " (" + hostname + ")"
+	}
+	sink := ttydSink{conn: conn, stats: &sess.output}
+	if err := sink.send(ttydSetTitle, []byte(title)); err != nil {
+		slog.Warn("failed to send window title", "error", err)
+		return
+	}
+	if err := sink.send(ttydSetPreferences, []byte("{}")); err != nil {
+		slog.Warn("failed to send preferences", "error", err)
+		return
+	}
+	filter := newOutputFilter(h.cfg)
+	if len(scrollback) > 0 && (resumed || sub.viewer) {
+		scrollback, _ = filter.filter(scrollback)
+		if err := sink.sendData(scrollback); err != nil {
+			slog.Warn("failed to replay scrollback", "error", err)
+			return
+		}
+	}
+
+	flow := newManualFlow()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		closeAfterOutput(conn, sess, ptyToWebSocket(ctx, sub, sink, flow, filter, newCoalescer(h.cfg, &h.stats)))
+	}()
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		if err := ttydToPTY(conn, sess, sub, flow); err != nil {
+			slog.Error("WebSocket to PTY error", "error", err)
+		}
+	}()
+	wg.Wait()
+}
+
+// readTTYDHandshake reads the client's initial JSON message.
+func readTTYDHandshake(conn *wsConn) (ttydInit, error) {
+	var init ttydInit
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return init, err
+	}
+	if len(data) == 0 || data[0] != ttydHandshake {
+		return init, errors.New("expected JSON handshake")
+	}
+	if err := json.Unmarshal(data, &init); err != nil {
+		return init, fmt.Errorf("invalid handshake: %w", err)
+	}
+	return init, nil
+}
+
+// ttydToPTY handles ttyd client commands until the connection closes.
+func ttydToPTY(conn *wsConn, sess *session, sub *subscriber, flow *flowControl) error {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			return err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		switch data[0] {
+		case ttydInput:
+			if err := writeInput(conn, sess, sub, data[1:], true); err != nil {
+				return err
+			}
+		case ttydResize:
+			var size ttydInit
+			if err := json.Unmarshal(data[1:], &size); err != nil {
+				slog.Debug("ignoring malformed ttyd resize", "error", err)
+				continue
+			}
+			resizePTY(conn, sess, sub, Message{Cols: size.Columns, Rows: size.Rows}, true)
+		case ttydPause:
+			flow.hold(true)
+		case ttydResume:
+			flow.hold(false)
+		default:
+			slog.Debug("ignoring unknown ttyd command", "command", string(data[0]))
+		}
+	}
+}
+
+// ttydSink writes output as ttyd OUTPUT commands. ttyd has no session
+// notifications, so events are dropped.
+type ttydSink struct {
+	conn  *wsConn
+	stats *compressionStats
+}
+
+func (s ttydSink) send(command byte, payload []byte) error {
+	frame := make([]byte, 1+len(payload))
+	frame[0] = command
+	copy(frame[1:], payload)
+	return s.conn.writeData(websocket.BinaryMessage, frame, s.stats)
+}
+
+func (s ttydSink) sendData(data []byte) error {
+	return s.send(ttydOutput, data)
+}
+
+func (s ttydSink) sendEvent(Message) error {
+	return nil
+}